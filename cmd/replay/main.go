@@ -0,0 +1,182 @@
+// Command replay replays a market's order events through the matcher
+// offline and compares the results against the stored results, reporting
+// the first diverging sequence. The rolling hash chain of the stored
+// results is verified first.
+//
+// Commands are loaded from the order events of the DB or from a JSON lines
+// file exported by a previous run with -export.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/corverroos/exchange"
+	"github.com/corverroos/exchange/db"
+	"github.com/corverroos/exchange/db/orders"
+	"github.com/corverroos/exchange/markets"
+	"github.com/corverroos/exchange/matcher"
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/log"
+)
+
+var (
+	market      = flag.String("market", orders.DefaultMarket, "market to replay")
+	marketsPath = flag.String("markets", "", "market configs YAML file")
+	commands    = flag.String("commands", "", "commands JSON lines file, loads order events from the DB if empty")
+	export      = flag.String("export", "", "file to export the commands to as JSON lines")
+	out         = flag.String("out", "", "file to write the replayed results to as JSON lines")
+	verify      = flag.Bool("verify", true, "compare the replayed results against the stored results")
+)
+
+func main() {
+	flag.Parse()
+
+	diverged, err := run(context.Background())
+	if err != nil {
+		log.Error(context.Background(), err)
+		os.Exit(1)
+	} else if diverged {
+		os.Exit(2)
+	}
+}
+
+func run(ctx context.Context) (bool, error) {
+	if *marketsPath != "" {
+		if err := markets.Load(*marketsPath); err != nil {
+			return false, err
+		}
+	}
+
+	cfg, err := markets.Lookup(*market)
+	if err != nil {
+		return false, err
+	}
+
+	var (
+		cl     []matcher.Command
+		stored []matcher.Result
+	)
+	if *commands != "" {
+		f, err := os.Open(*commands)
+		if err != nil {
+			return false, err
+		}
+		defer f.Close()
+
+		cl, err = exchange.ReadCommands(f)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if *commands == "" || *verify {
+		dbc, err := db.Connect()
+		if err != nil {
+			return false, err
+		}
+		defer dbc.Close()
+
+		var seq int64
+		stored, seq, err = exchange.LoadResults(ctx, dbc, *market)
+		if err != nil {
+			return false, err
+		}
+
+		if *commands == "" {
+			cl, err = exchange.LoadCommands(ctx, dbc, *market, seq)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	if *export != "" {
+		if err := writeFile(*export, func(f *os.File) error {
+			return exchange.WriteCommands(f, cl)
+		}); err != nil {
+			return false, err
+		}
+	}
+
+	rl, err := exchange.Replay(ctx, cl, cfg)
+	if err != nil {
+		return false, err
+	}
+
+	if *out != "" {
+		if err := writeFile(*out, func(f *os.File) error {
+			enc := json.NewEncoder(f)
+			for _, r := range rl {
+				if err := enc.Encode(r); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return false, err
+		}
+	}
+
+	if !*verify {
+		fmt.Printf("replayed %d commands, %d results\n", len(cl), len(rl))
+		return false, nil
+	}
+
+	if seq, broken, err := exchange.FirstBrokenHash(cl, stored); err != nil {
+		return false, err
+	} else if broken {
+		fmt.Printf("invalid stored hash at sequence %d\n", seq)
+		fmt.Printf("stored:   %s\n", find(stored, seq))
+		return true, nil
+	}
+
+	seq, diverged, err := exchange.FirstDivergence(stored, rl)
+	if err != nil {
+		return false, err
+	} else if !diverged {
+		fmt.Printf("ok: %d results identical\n", len(rl))
+		return false, nil
+	}
+
+	fmt.Printf("diverged at sequence %d\n", seq)
+	fmt.Printf("stored:   %s\n", find(stored, seq))
+	fmt.Printf("replayed: %s\n", find(rl, seq))
+
+	return true, nil
+}
+
+// find returns the JSON encoding of the result of the sequence or
+// "<missing>" if not found.
+func find(rl []matcher.Result, seq int64) string {
+	for _, r := range rl {
+		if r.Sequence != seq {
+			continue
+		}
+
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err.Error()
+		}
+		return string(b)
+	}
+
+	return "<missing>"
+}
+
+func writeFile(path string, fn func(*os.File) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(f); err != nil {
+		f.Close()
+		return errors.Wrap(err, "write file")
+	}
+
+	return f.Close()
+}
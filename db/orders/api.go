@@ -3,43 +3,279 @@ package orders
 import (
 	"context"
 	"database/sql"
+	"time"
 
+	"github.com/corverroos/exchange/markets"
 	"github.com/luno/jettison/errors"
 	"github.com/luno/jettison/j"
 	"github.com/shopspring/decimal"
 )
 
+// CreateOption sets optional fields of an order create request.
+type CreateOption func(*CreateReq)
+
+// WithTimeInForce returns an option to set the time in force of a limit
+// order. The default is TimeInForceGTC. It is ignored for post only orders.
+func WithTimeInForce(tif TimeInForce) CreateOption {
+	return func(req *CreateReq) {
+		req.TimeInForce = tif
+	}
+}
+
+// WithExpiry returns an option to expire a posted limit order at the
+// provided time. See SweepExpired.
+func WithExpiry(t time.Time) CreateOption {
+	return func(req *CreateReq) {
+		req.ExpiresAt = sql.NullTime{Time: t, Valid: true}
+	}
+}
+
+// WithDisplayVolume returns an option to create an iceberg limit order
+// that only displays the provided volume in the order book at a time.
+func WithDisplayVolume(volume decimal.Decimal) CreateOption {
+	return func(req *CreateReq) {
+		req.DisplayVolume = volume
+	}
+}
+
+// WithSlide returns an option to reprice a post only order to one tick
+// behind the best opposite price if it would otherwise trade. The order is
+// then posted at the adjusted price instead of failing.
+func WithSlide() CreateOption {
+	return func(req *CreateReq) {
+		req.Slide = true
+	}
+}
+
+// WithMarket returns an option to create the order in the market (pair).
+// The default is DefaultMarket.
+func WithMarket(market string) CreateOption {
+	return func(req *CreateReq) {
+		req.Market = market
+	}
+}
+
+// WithAccount returns an option to set the account that owns the order.
+// Orders of the same account never trade with each other, see WithSTP.
+func WithAccount(id int64) CreateOption {
+	return func(req *CreateReq) {
+		req.AccountID = id
+	}
+}
+
+// WithSTP returns an option to set the self-trade prevention mode applied
+// when the order would trade with an order of the same account. The default
+// is STPCancelNewest.
+func WithSTP(stp STP) CreateOption {
+	return func(req *CreateReq) {
+		req.STP = stp
+	}
+}
+
+// WithWorstPrice returns an option to stop a market order from trading
+// at prices worse than the provided price; above it for buys and below it
+// for sells. The remaining amount is cancelled.
+func WithWorstPrice(price decimal.Decimal) CreateOption {
+	return func(req *CreateReq) {
+		req.WorstPrice = price
+	}
+}
+
+// WithMaxSlippage returns an option to stop a market order from trading
+// at prices worse than the percentage relative to the best price when
+// matched. The remaining amount is cancelled. If combined with
+// WithWorstPrice, the more conservative price applies.
+func WithMaxSlippage(pct decimal.Decimal) CreateOption {
+	return func(req *CreateReq) {
+		req.MaxSlippage = pct
+	}
+}
+
 func CreateLimit(ctx context.Context, dbc *sql.DB, isBuy bool, price, volume decimal.Decimal,
-	isPostOnly bool) (int64, error) {
+	isPostOnly bool, opts ...CreateOption) (int64, error) {
 
 	typ := TypeLimit
 	if isPostOnly {
 		typ = TypePostOnly
 	}
 
-	return fsm.Insert(ctx, dbc, CreateReq{
+	return insert(ctx, dbc, CreateReq{
 		IsBuy:       isBuy,
 		Type:        typ,
 		LimitVolume: volume,
 		LimitPrice:  price,
-	})
+	}, opts...)
 }
 
-func CreateMarketSell(ctx context.Context, dbc *sql.DB, counter decimal.Decimal) (int64, error) {
-	return fsm.Insert(ctx, dbc, CreateReq{
+func CreateMarketSell(ctx context.Context, dbc *sql.DB, counter decimal.Decimal,
+	opts ...CreateOption) (int64, error) {
+
+	return insert(ctx, dbc, CreateReq{
 		Type:          TypeMarket,
 		IsBuy:         false,
 		MarketCounter: counter,
-	})
+	}, opts...)
+}
+
+func CreateMarketBuy(ctx context.Context, dbc *sql.DB, base decimal.Decimal,
+	opts ...CreateOption) (int64, error) {
+
+	return insert(ctx, dbc, CreateReq{
+		Type:       TypeMarket,
+		IsBuy:      true,
+		MarketBase: base,
+	}, opts...)
+}
+
+// CreateMarketBuyCounter creates a market order that buys exactly the
+// counter volume, eg. buy 1 BTC.
+func CreateMarketBuyCounter(ctx context.Context, dbc *sql.DB, counter decimal.Decimal,
+	opts ...CreateOption) (int64, error) {
+
+	return insert(ctx, dbc, CreateReq{
+		Type:          TypeMarket,
+		IsBuy:         true,
+		MarketCounter: counter,
+	}, opts...)
 }
 
-func CreateMarketBuy(ctx context.Context, dbc *sql.DB, base decimal.Decimal) (int64, error) {
-	return fsm.Insert(ctx, dbc, CreateReq{
+// CreateMarketSellBase creates a market order that sells enough counter
+// volume to receive the base amount, eg. receive 1000 USD. The volume
+// is rounded down, so slightly less may be received.
+func CreateMarketSellBase(ctx context.Context, dbc *sql.DB, base decimal.Decimal,
+	opts ...CreateOption) (int64, error) {
+
+	return insert(ctx, dbc, CreateReq{
 		Type:       TypeMarket,
+		IsBuy:      false,
+		MarketBase: base,
+	}, opts...)
+}
+
+// CreateStopSell creates a stop order that sells the counter amount
+// at market when a trade price is at or below the stop price.
+func CreateStopSell(ctx context.Context, dbc *sql.DB, stopPrice, counter decimal.Decimal,
+	opts ...CreateOption) (int64, error) {
+
+	return insert(ctx, dbc, CreateReq{
+		Type:          TypeStop,
+		IsBuy:         false,
+		StopPrice:     stopPrice,
+		MarketCounter: counter,
+	}, opts...)
+}
+
+// CreateStopBuy creates a stop order that buys with the base amount
+// at market when a trade price is at or above the stop price.
+func CreateStopBuy(ctx context.Context, dbc *sql.DB, stopPrice, base decimal.Decimal,
+	opts ...CreateOption) (int64, error) {
+
+	return insert(ctx, dbc, CreateReq{
+		Type:       TypeStop,
 		IsBuy:      true,
+		StopPrice:  stopPrice,
 		MarketBase: base,
-	})
+	}, opts...)
+}
+
+// CreateStopLimit creates a stop order that is converted to a limit order
+// when a trade price crosses the stop price; at or above for buys,
+// at or below for sells.
+func CreateStopLimit(ctx context.Context, dbc *sql.DB, isBuy bool, stopPrice, price,
+	volume decimal.Decimal, opts ...CreateOption) (int64, error) {
+
+	return insert(ctx, dbc, CreateReq{
+		Type:        TypeStopLimit,
+		IsBuy:       isBuy,
+		StopPrice:   stopPrice,
+		LimitVolume: volume,
+		LimitPrice:  price,
+	}, opts...)
 }
+
+// insert inserts the create request after applying the options and
+// validating it against the market config.
+func insert(ctx context.Context, dbc *sql.DB, req CreateReq, opts ...CreateOption) (int64, error) {
+	for _, opt := range opts {
+		opt(&req)
+	}
+
+	cfg, err := markets.Lookup(req.Market)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := validate(req, cfg); err != nil {
+		return 0, errors.Wrap(err, "invalid order", j.KV("market", req.Market))
+	}
+
+	return fsm.Insert(ctx, dbc, req)
+}
+
+// validate returns an error if the create request doesn't
+// conform to the market config.
+func validate(req CreateReq, cfg markets.Config) error {
+	switch req.Type {
+	case TypeLimit, TypePostOnly:
+		return validateLimit(req, cfg)
+
+	case TypeMarket:
+		return validateMarket(req, cfg)
+
+	case TypeStop:
+		if err := cfg.ValidatePrice(req.StopPrice); err != nil {
+			return err
+		}
+		return validateMarket(req, cfg)
+
+	case TypeStopLimit:
+		if err := cfg.ValidatePrice(req.StopPrice); err != nil {
+			return err
+		}
+		return validateLimit(req, cfg)
+
+	default:
+		return errors.New("unknown order type", j.KV("type", req.Type))
+	}
+}
+
+func validateLimit(req CreateReq, cfg markets.Config) error {
+	if req.Slide && req.Type != TypePostOnly {
+		return errors.New("slide only applicable to post only orders")
+	}
+
+	if err := cfg.ValidateLimit(req.LimitPrice, req.LimitVolume); err != nil {
+		return err
+	}
+
+	if req.DisplayVolume.Sign() != 0 {
+		return cfg.ValidateVolume(req.DisplayVolume)
+	}
+
+	return nil
+}
+
+func validateMarket(req CreateReq, cfg markets.Config) error {
+	if req.WorstPrice.Sign() != 0 {
+		if err := cfg.ValidatePrice(req.WorstPrice); err != nil {
+			return err
+		}
+	}
+
+	if req.MaxSlippage.Sign() != 0 {
+		if err := markets.ValidateSlippage(req.MaxSlippage); err != nil {
+			return err
+		}
+	}
+
+	if req.MarketBase.Sign() != 0 && req.MarketCounter.Sign() != 0 {
+		return markets.ErrAmountAndVolume
+	} else if req.MarketBase.Sign() != 0 {
+		return cfg.ValidateAmount(req.MarketBase)
+	}
+	return cfg.ValidateVolume(req.MarketCounter)
+}
+
 func RequestCancel(ctx context.Context, dbc *sql.DB, id int64) error {
 	o, err := Lookup(ctx, dbc, id)
 	if err != nil {
@@ -50,7 +286,7 @@ func RequestCancel(ctx context.Context, dbc *sql.DB, id int64) error {
 		return errors.New("cannot cancel complete order")
 	}
 
-	err = fsm.Update(ctx, dbc, o.Status, StatusCancelling, cancelReq{ID: id, isBuy: o.IsBuy})
+	err = fsm.Update(ctx, dbc, o.Status, StatusCancelling, cancelReq{ID: id, isBuy: o.IsBuy, market: o.Market})
 	if err != nil {
 		return errors.Wrap(err, "cancelling error",
 			j.MKV{"id": id, "status": o.Status})
@@ -59,28 +295,138 @@ func RequestCancel(ctx context.Context, dbc *sql.DB, id int64) error {
 	return nil
 }
 
+// ListExpired returns up to limit posted orders that expired at or before
+// the provided time.
+func ListExpired(ctx context.Context, dbc *sql.DB, now time.Time, limit int) ([]Order, error) {
+	return listWhere(ctx, dbc, "status=? and expires_at<=? order by id limit ?",
+		StatusPosted, now, limit)
+}
+
+// ListSlow returns up to limit orders created at or after the provided
+// time with the longest duration from created to last updated.
+func ListSlow(ctx context.Context, dbc *sql.DB, since time.Time, limit int) ([]Order, error) {
+	return listWhere(ctx, dbc, "created_at>=? order by "+
+		"timestampdiff(microsecond, created_at, updated_at) desc, id limit ?",
+		since, limit)
+}
+
+// RequestExpire moves the posted order to StatusExpiring which results
+// in the matcher removing it from the order book.
+func RequestExpire(ctx context.Context, dbc *sql.DB, id int64) error {
+	o, err := Lookup(ctx, dbc, id)
+	if err != nil {
+		return err
+	}
+
+	err = fsm.Update(ctx, dbc, StatusPosted, StatusExpiring, expireReq{ID: id, isBuy: o.IsBuy, market: o.Market})
+	if err != nil {
+		return errors.Wrap(err, "expiring error",
+			j.MKV{"id": id, "status": o.Status})
+	}
+
+	return nil
+}
+
+// RequestAmend moves the posted limit order to StatusAmending which results
+// in the matcher changing its price and volume. The volume is the new total
+// volume of the order, including any volume already filled. Reducing the
+// volume at the same price retains time priority.
+func RequestAmend(ctx context.Context, dbc *sql.DB, id int64, price, volume decimal.Decimal) error {
+	o, err := Lookup(ctx, dbc, id)
+	if err != nil {
+		return err
+	}
+
+	if o.Type == TypeMarket || o.Type == TypeStop {
+		return errors.New("cannot amend market order", j.KV("id", id))
+	}
+
+	cfg, err := markets.Lookup(o.Market)
+	if err != nil {
+		return err
+	}
+
+	if err := cfg.ValidateLimit(price, volume); err != nil {
+		return errors.Wrap(err, "invalid amend", j.KV("id", id))
+	}
+
+	r := amendReq{
+		ID:          id,
+		AmendPrice:  price,
+		AmendVolume: volume,
+	}
+
+	err = fsm.Update(ctx, dbc, StatusPosted, StatusAmending, r)
+	if err != nil {
+		return errors.Wrap(err, "amending error",
+			j.MKV{"id": id, "status": o.Status})
+	}
+
+	return nil
+}
+
 func UpdatePosted(ctx context.Context, dbc *sql.DB, id int64, seq int64) error {
 	o, err := Lookup(ctx, dbc, id)
 	if err != nil {
 		return err
 	}
 
+	return updatePosted(ctx, dbc, o, seq, o.LimitPrice, o.LimitVolume)
+}
+
+// UpdateSlid moves the slid post only order to StatusPosted
+// replacing its limit price with the adjusted price.
+func UpdateSlid(ctx context.Context, dbc *sql.DB, id int64, seq int64,
+	price decimal.Decimal) error {
+
+	o, err := Lookup(ctx, dbc, id)
+	if err != nil {
+		return err
+	}
+
+	return updatePosted(ctx, dbc, o, seq, price, o.LimitVolume)
+}
+
+// UpdateAmended moves the amending order back to StatusPosted
+// replacing its limit price and volume with the amended values.
+func UpdateAmended(ctx context.Context, dbc *sql.DB, id int64, seq int64) error {
+	o, err := Lookup(ctx, dbc, id)
+	if err != nil {
+		return err
+	}
+
+	return updatePosted(ctx, dbc, o, seq, o.AmendPrice, o.AmendVolume)
+}
+
+func updatePosted(ctx context.Context, dbc *sql.DB, o *Order, seq int64,
+	price, volume decimal.Decimal) error {
+
 	if o.UpdateSeq >= seq {
 		// This sequence was already processed.
 		return nil
 	}
 
-	if o.Status == StatusCancelling {
-		// Skip posted if cancelling
+	if o.Status == StatusCancelling || o.Status == StatusComplete {
+		// Skip posted if cancelling or already filled.
+		return nil
+	}
+
+	if o.Status == StatusPosted && o.LimitPrice.Equal(price) &&
+		o.LimitVolume.Equal(volume) {
+		// Stop-limit orders are posted when accepted, so they are
+		// already posted when triggered and resting. Posted to posted
+		// isn't a valid transition.
 		return nil
 	}
 
 	r := postReq{
-		ID:        id,
-		UpdateSeq: seq,
+		ID:          o.ID,
+		UpdateSeq:   seq,
+		LimitPrice:  price,
+		LimitVolume: volume,
 	}
 
-	err = fsm.Update(ctx, dbc, o.Status, StatusPosted, r)
+	err := fsm.Update(ctx, dbc, o.Status, StatusPosted, r)
 	if err != nil {
 		return errors.Wrap(err, "posted error")
 	}
@@ -94,8 +440,10 @@ func Complete(ctx context.Context, dbc *sql.DB, id int64, seq int64) error {
 		return err
 	}
 
-	if o.UpdateSeq >= seq {
-		// This sequence was already processed.
+	if o.Status == StatusComplete || o.UpdateSeq > seq {
+		// Already completed or a later sequence was already processed.
+		// Note that triggered stops may complete an order posted
+		// in the same sequence.
 		return nil
 	}
 
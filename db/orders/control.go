@@ -0,0 +1,132 @@
+package orders
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/luno/jettison/errors"
+	"github.com/shopspring/decimal"
+)
+
+// ControlType is the type of market control events. Control events are
+// inserted into the order events stream so they are applied by the matcher
+// deterministically relative to order events. Control types don't
+// overlap with order statuses.
+type ControlType int
+
+const (
+	// ControlAuctionStart starts a call auction; orders accumulate without
+	// matching until uncrossed.
+	ControlAuctionStart ControlType = 100
+
+	// ControlUncross executes the call auction at the clearing price and
+	// resumes continuous matching.
+	ControlUncross ControlType = 101
+
+	// ControlHalt halts the market; new orders are rejected while
+	// cancels are still applied.
+	ControlHalt ControlType = 102
+
+	// ControlResume resumes continuous matching of a halted market.
+	ControlResume ControlType = 103
+
+	// ControlMassCancel removes all orders selected by the filter from
+	// the order book in one step.
+	ControlMassCancel ControlType = 104
+)
+
+func (c ControlType) ReflexType() int {
+	return int(c)
+}
+
+// ControlMetadata is the metadata of control events.
+type ControlMetadata struct {
+	Market string
+	Filter *CancelFilter `json:",omitempty"` // Only mass cancels.
+}
+
+// CancelSide selects the side of orders to mass cancel.
+type CancelSide int
+
+const (
+	CancelBoth CancelSide = 0
+	CancelBids CancelSide = 1
+	CancelAsks CancelSide = 2
+)
+
+// CancelFilter selects the orders to mass cancel. Stop orders are selected
+// by their stop price. The zero value selects all orders of the market.
+type CancelFilter struct {
+	AccountID int64           `json:",omitempty"` // Only orders of the account if non-zero.
+	Side      CancelSide      `json:",omitempty"` // Only orders of the side.
+	MinPrice  decimal.Decimal // Only orders priced at or above if non-zero.
+	MaxPrice  decimal.Decimal // Only orders priced at or below if non-zero.
+}
+
+// InsertControl inserts a control event of the market into the order
+// events stream.
+func InsertControl(ctx context.Context, dbc *sql.DB, market string, typ ControlType) error {
+	return insertControl(ctx, dbc, typ, ControlMetadata{Market: market})
+}
+
+func insertControl(ctx context.Context, dbc *sql.DB, typ ControlType, m ControlMetadata) error {
+	meta, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbc.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	notify, err := events.InsertWithMetadata(ctx, tx, 0, typ, meta)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	notify()
+
+	return nil
+}
+
+// StartAuction starts a call auction in the market.
+func StartAuction(ctx context.Context, dbc *sql.DB, market string) error {
+	return InsertControl(ctx, dbc, market, ControlAuctionStart)
+}
+
+// Uncross executes the call auction in the market.
+func Uncross(ctx context.Context, dbc *sql.DB, market string) error {
+	return InsertControl(ctx, dbc, market, ControlUncross)
+}
+
+// Halt halts the market. Use Resume or StartAuction to re-open it.
+func Halt(ctx context.Context, dbc *sql.DB, market string) error {
+	return InsertControl(ctx, dbc, market, ControlHalt)
+}
+
+// Resume resumes the halted market.
+func Resume(ctx context.Context, dbc *sql.DB, market string) error {
+	return InsertControl(ctx, dbc, market, ControlResume)
+}
+
+// MassCancel cancels all orders of the market selected by the filter
+// with a single sequenced command. The orders are completed when the
+// result is consumed.
+func MassCancel(ctx context.Context, dbc *sql.DB, market string, f CancelFilter) error {
+	if f.Side < CancelBoth || f.Side > CancelAsks {
+		return errors.New("invalid cancel side")
+	} else if f.MinPrice.Sign() < 0 || f.MaxPrice.Sign() < 0 {
+		return errors.New("negative cancel price")
+	} else if !f.MaxPrice.IsZero() && f.MinPrice.GreaterThan(f.MaxPrice) {
+		return errors.New("min cancel price above max")
+	}
+
+	return insertControl(ctx, dbc, ControlMassCancel,
+		ControlMetadata{Market: market, Filter: &f})
+}
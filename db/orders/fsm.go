@@ -11,7 +11,7 @@ import (
 	"github.com/shopspring/decimal"
 )
 
-//go:generate shiftgen -inserter=CreateReq -updaters=postReq,cancelReq,completeReq -table=orders
+//go:generate shiftgen -inserter=CreateReq -updaters=postReq,cancelReq,completeReq,expireReq,amendReq -table=orders
 
 var (
 	events = rsql.NewEventsTableInt("order_events",
@@ -20,31 +20,65 @@ var (
 
 	fsm = shift.NewFSM(events, shift.WithMetadata()).
 		Insert(StatusPending, CreateReq{}, StatusComplete, StatusCancelling, StatusPosted).
-		Update(StatusPosted, postReq{}, StatusComplete, StatusCancelling).
+		Update(StatusPosted, postReq{}, StatusComplete, StatusCancelling, StatusExpiring, StatusAmending).
 		Update(StatusCancelling, cancelReq{}, StatusComplete).
+		Update(StatusExpiring, expireReq{}, StatusComplete).
+		Update(StatusAmending, amendReq{}, StatusPosted, StatusComplete, StatusCancelling).
 		Update(StatusComplete, completeReq{}).Build()
 )
 
 type (
 	CreateReq struct {
-		Type  Type
-		IsBuy bool
+		Market    string
+		AccountID int64
+		Type      Type
+		IsBuy     bool
 
 		LimitVolume decimal.Decimal
 		LimitPrice  decimal.Decimal
 
 		MarketBase    decimal.Decimal
 		MarketCounter decimal.Decimal
+
+		WorstPrice  decimal.Decimal
+		MaxSlippage decimal.Decimal
+
+		StopPrice decimal.Decimal
+
+		TimeInForce TimeInForce
+
+		STP STP
+
+		ExpiresAt sql.NullTime
+
+		DisplayVolume decimal.Decimal
+
+		Slide bool
 	}
 
 	cancelReq struct {
-		ID    int64
-		isBuy bool // Only for metadata
+		ID     int64
+		isBuy  bool   // Only for metadata
+		market string // Only for metadata
+	}
+
+	expireReq struct {
+		ID     int64
+		isBuy  bool   // Only for metadata
+		market string // Only for metadata
+	}
+
+	amendReq struct {
+		ID          int64
+		AmendPrice  decimal.Decimal
+		AmendVolume decimal.Decimal
 	}
 
 	postReq struct {
-		ID        int64
-		UpdateSeq int64
+		ID          int64
+		UpdateSeq   int64
+		LimitPrice  decimal.Decimal
+		LimitVolume decimal.Decimal
 	}
 
 	completeReq struct {
@@ -53,6 +87,29 @@ type (
 	}
 )
 
+// CancelMetadata is the metadata of StatusCancelling
+// and StatusExpiring events.
+type CancelMetadata struct {
+	Market string
+	IsBuy  bool
+}
+
+// AmendMetadata is the metadata of StatusAmending events.
+type AmendMetadata struct {
+	Market string
+	IsBuy  bool
+
+	// Price is the new limit price.
+	Price decimal.Decimal
+
+	// VolumeDelta is the change in limit volume,
+	// negative if reduced.
+	VolumeDelta decimal.Decimal
+
+	// Volume is the new limit volume.
+	Volume decimal.Decimal
+}
+
 func ToStream(dbc *sql.DB) reflex.StreamFunc {
 	return events.ToStream(dbc)
 }
@@ -62,7 +119,26 @@ func FillGaps(dbc *sql.DB) {
 }
 
 func (r cancelReq) GetMetadata(ctx context.Context, tx *sql.Tx, from shift.Status, to shift.Status) ([]byte, error) {
-	return json.Marshal(&r.isBuy)
+	return json.Marshal(CancelMetadata{Market: r.market, IsBuy: r.isBuy})
+}
+
+func (r expireReq) GetMetadata(ctx context.Context, tx *sql.Tx, from shift.Status, to shift.Status) ([]byte, error) {
+	return json.Marshal(CancelMetadata{Market: r.market, IsBuy: r.isBuy})
+}
+
+func (r amendReq) GetMetadata(ctx context.Context, tx *sql.Tx, from shift.Status, to shift.Status) ([]byte, error) {
+	o, err := Lookup(ctx, tx, r.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(AmendMetadata{
+		Market:      o.Market,
+		IsBuy:       o.IsBuy,
+		Price:       r.AmendPrice,
+		VolumeDelta: r.AmendVolume.Sub(o.LimitVolume),
+		Volume:      r.AmendVolume,
+	})
 }
 
 func (r postReq) GetMetadata(ctx context.Context, tx *sql.Tx, from shift.Status, to shift.Status) ([]byte, error) {
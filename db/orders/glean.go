@@ -1,6 +1,10 @@
 package orders
 
-import "database/sql"
+import (
+	"database/sql"
+
+	"github.com/shopspring/decimal"
+)
 
 //go:generate glean -table=orders -scan
 
@@ -8,4 +12,8 @@ type glean struct {
 	Order
 
 	UpdateSeq sql.NullInt64
+	ExpiresAt sql.NullTime
+
+	AmendPrice  decimal.NullDecimal
+	AmendVolume decimal.NullDecimal
 }
@@ -8,7 +8,7 @@ import (
 	"time"
 )
 
-const cols = " `id`, `type`, `is_buy`, `status`, `limit_volume`, `limit_price`, `market_base`, `market_counter`, `created_at`, `updated_at`, `update_seq` "
+const cols = " `id`, `market`, `account_id`, `type`, `is_buy`, `status`, `limit_volume`, `limit_price`, `market_base`, `market_counter`, `worst_price`, `max_slippage`, `stop_price`, `time_in_force`, `stp`, `display_volume`, `slide`, `created_at`, `updated_at`, `update_seq`, `expires_at`, `amend_price`, `amend_volume` "
 const selectPrefix = "select " + cols + " from orders where "
 
 var _ time.Time
@@ -114,13 +114,15 @@ func listWhere(ctx context.Context, dbc dbc, where string, args ...interface{})
 func scan(row row) (*Order, error) {
 	var g glean
 
-	err := row.Scan(&g.ID, &g.Type, &g.IsBuy, &g.Status, &g.LimitVolume, &g.LimitPrice, &g.MarketBase, &g.MarketCounter, &g.CreatedAt, &g.UpdatedAt, &g.UpdateSeq)
+	err := row.Scan(&g.ID, &g.Market, &g.AccountID, &g.Type, &g.IsBuy, &g.Status, &g.LimitVolume, &g.LimitPrice, &g.MarketBase, &g.MarketCounter, &g.WorstPrice, &g.MaxSlippage, &g.StopPrice, &g.TimeInForce, &g.STP, &g.DisplayVolume, &g.Slide, &g.CreatedAt, &g.UpdatedAt, &g.UpdateSeq, &g.ExpiresAt, &g.AmendPrice, &g.AmendVolume)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Order{
 		ID:            g.ID,
+		Market:        g.Market,
+		AccountID:     g.AccountID,
 		Type:          g.Type,
 		IsBuy:         g.IsBuy,
 		Status:        g.Status,
@@ -128,9 +130,19 @@ func scan(row row) (*Order, error) {
 		LimitPrice:    g.LimitPrice,
 		MarketBase:    g.MarketBase,
 		MarketCounter: g.MarketCounter,
+		WorstPrice:    g.WorstPrice,
+		MaxSlippage:   g.MaxSlippage,
+		StopPrice:     g.StopPrice,
+		TimeInForce:   g.TimeInForce,
+		STP:           g.STP,
+		DisplayVolume: g.DisplayVolume,
+		Slide:         g.Slide,
 		CreatedAt:     g.CreatedAt,
 		UpdatedAt:     g.UpdatedAt,
 		UpdateSeq:     g.UpdateSeq.Int64,
+		ExpiresAt:     g.ExpiresAt.Time,
+		AmendPrice:    g.AmendPrice.Decimal,
+		AmendVolume:   g.AmendVolume.Decimal,
 	}, nil
 }
 
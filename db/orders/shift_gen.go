@@ -24,6 +24,12 @@ func (一 CreateReq) Insert(ctx context.Context, tx *sql.Tx,st shift.Status) (in
 	q.WriteString("insert into orders set `status`=?, `created_at`=?, `updated_at`=? ")
 	args = append(args, st.ShiftStatus(), time.Now(), time.Now())
 
+	q.WriteString(", `market`=?")
+	args = append(args, 一.Market)
+
+	q.WriteString(", `account_id`=?")
+	args = append(args, 一.AccountID)
+
 	q.WriteString(", `type`=?")
 	args = append(args, 一.Type)
 
@@ -42,6 +48,30 @@ func (一 CreateReq) Insert(ctx context.Context, tx *sql.Tx,st shift.Status) (in
 	q.WriteString(", `market_counter`=?")
 	args = append(args, 一.MarketCounter)
 
+	q.WriteString(", `worst_price`=?")
+	args = append(args, 一.WorstPrice)
+
+	q.WriteString(", `max_slippage`=?")
+	args = append(args, 一.MaxSlippage)
+
+	q.WriteString(", `stop_price`=?")
+	args = append(args, 一.StopPrice)
+
+	q.WriteString(", `time_in_force`=?")
+	args = append(args, 一.TimeInForce)
+
+	q.WriteString(", `stp`=?")
+	args = append(args, 一.STP)
+
+	q.WriteString(", `expires_at`=?")
+	args = append(args, 一.ExpiresAt)
+
+	q.WriteString(", `display_volume`=?")
+	args = append(args, 一.DisplayVolume)
+
+	q.WriteString(", `slide`=?")
+	args = append(args, 一.Slide)
+
 	res, err := tx.ExecContext(ctx, q.String(), args...)
 	if err != nil {
 		return 0, err
@@ -70,6 +100,9 @@ func (一 cancelReq) Update(ctx context.Context, tx *sql.Tx,from shift.Status,
 	q.WriteString(", `is_buy`=?")
 	args = append(args, 一.isBuy)
 
+	q.WriteString(", `market`=?")
+	args = append(args, 一.market)
+
 	q.WriteString(" where `id`=? and `status`=?")
 	args = append(args, 一.ID, from.ShiftStatus())
 
@@ -104,6 +137,12 @@ func (一 postReq) Update(ctx context.Context, tx *sql.Tx,from shift.Status,
 	q.WriteString(", `update_seq`=?")
 	args = append(args, 一.UpdateSeq)
 
+	q.WriteString(", `limit_price`=?")
+	args = append(args, 一.LimitPrice)
+
+	q.WriteString(", `limit_volume`=?")
+	args = append(args, 一.LimitVolume)
+
 	q.WriteString(" where `id`=? and `status`=?")
 	args = append(args, 一.ID, from.ShiftStatus())
 
@@ -155,3 +194,77 @@ func (一 completeReq) Update(ctx context.Context, tx *sql.Tx,from shift.Status,
 
 	return 一.ID, nil
 }
+
+// Update updates the status of a orders table entity. All the fields of the
+// expireReq receiver are updated, as well as status and updated_at. 
+// The entity id is returned on success or an error.
+func (一 expireReq) Update(ctx context.Context, tx *sql.Tx,from shift.Status, 
+	to shift.Status) (int64, error) {
+	var (
+		q    strings.Builder
+		args []interface{}
+	)
+
+	q.WriteString("update orders set `status`=?, `updated_at`=? ")
+	args = append(args, to.ShiftStatus(), time.Now())
+
+	q.WriteString(", `is_buy`=?")
+	args = append(args, 一.isBuy)
+
+	q.WriteString(", `market`=?")
+	args = append(args, 一.market)
+
+	q.WriteString(" where `id`=? and `status`=?")
+	args = append(args, 一.ID, from.ShiftStatus())
+
+	res, err := tx.ExecContext(ctx, q.String(), args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n != 1 {
+		return 0, errors.Wrap(shift.ErrRowCount, "expireReq", j.KV("count", n))
+	}
+
+	return 一.ID, nil
+}
+
+// Update updates the status of a orders table entity. All the fields of the
+// amendReq receiver are updated, as well as status and updated_at. 
+// The entity id is returned on success or an error.
+func (一 amendReq) Update(ctx context.Context, tx *sql.Tx,from shift.Status, 
+	to shift.Status) (int64, error) {
+	var (
+		q    strings.Builder
+		args []interface{}
+	)
+
+	q.WriteString("update orders set `status`=?, `updated_at`=? ")
+	args = append(args, to.ShiftStatus(), time.Now())
+
+	q.WriteString(", `amend_price`=?")
+	args = append(args, 一.AmendPrice)
+
+	q.WriteString(", `amend_volume`=?")
+	args = append(args, 一.AmendVolume)
+
+	q.WriteString(" where `id`=? and `status`=?")
+	args = append(args, 一.ID, from.ShiftStatus())
+
+	res, err := tx.ExecContext(ctx, q.String(), args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n != 1 {
+		return 0, errors.Wrap(shift.ErrRowCount, "amendReq", j.KV("count", n))
+	}
+
+	return 一.ID, nil
+}
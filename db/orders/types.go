@@ -7,10 +7,12 @@ import (
 )
 
 type Order struct {
-	ID     int64
-	Type   Type
-	IsBuy  bool
-	Status Status
+	ID        int64
+	Market    string // Market (pair) of the order, see DefaultMarket
+	AccountID int64  // Owner of the order, zero if unknown
+	Type      Type
+	IsBuy     bool
+	Status    Status
 
 	LimitVolume decimal.Decimal
 	LimitPrice  decimal.Decimal
@@ -18,6 +20,33 @@ type Order struct {
 	MarketBase    decimal.Decimal // Buying counter with X base
 	MarketCounter decimal.Decimal // Selling X counter for base
 
+	// WorstPrice and MaxSlippage (percent relative to the best price)
+	// protect market orders from trading at bad prices. Zero disables.
+	WorstPrice  decimal.Decimal
+	MaxSlippage decimal.Decimal
+
+	StopPrice decimal.Decimal // Trigger price of stop orders
+
+	TimeInForce TimeInForce // Only applicable to limit orders
+
+	STP STP // Self-trade prevention mode
+
+	// ExpiresAt is the time a posted order expires or zero if it doesn't.
+	ExpiresAt time.Time
+
+	// DisplayVolume is the visible volume of iceberg limit orders
+	// or zero for normal orders.
+	DisplayVolume decimal.Decimal
+
+	// Slide indicates that a crossing post only order is repriced to one
+	// tick behind the best opposite price instead of failing.
+	Slide bool
+
+	// AmendPrice and AmendVolume are the values of the last amend
+	// request. They replace the limit price and volume once amended.
+	AmendPrice  decimal.Decimal
+	AmendVolume decimal.Decimal
+
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	// UpdateSeq is the last match command result sequence
@@ -25,13 +54,54 @@ type Order struct {
 	UpdateSeq int64
 }
 
+// DefaultMarket is the market of orders created without WithMarket.
+const DefaultMarket = ""
+
 type Type int
 
 const (
-	TypeUnknown  Type = 0
-	TypeLimit    Type = 1
-	TypeMarket   Type = 2
-	TypePostOnly Type = 3
+	TypeUnknown   Type = 0
+	TypeLimit     Type = 1
+	TypeMarket    Type = 2
+	TypePostOnly  Type = 3
+	TypeStop      Type = 4
+	TypeStopLimit Type = 5
+)
+
+// TimeInForce defines how long a limit order remains active.
+type TimeInForce int
+
+const (
+	// TimeInForceGTC (good-till-cancelled) orders rest in the order book
+	// until filled or cancelled. This is the default.
+	TimeInForceGTC TimeInForce = 0
+
+	// TimeInForceIOC (immediate-or-cancel) orders trade what they can
+	// immediately and cancel the rest.
+	TimeInForceIOC TimeInForce = 1
+
+	// TimeInForceFOK (fill-or-kill) orders are either filled completely
+	// and immediately or cancelled without any trades.
+	TimeInForceFOK TimeInForce = 2
+)
+
+// STP (self-trade prevention) defines what happens when an order would
+// trade with an order of the same account. The mode of the incoming
+// (taker) order applies.
+type STP int
+
+const (
+	// STPCancelNewest cancels the incoming order. This is the default.
+	STPCancelNewest STP = 0
+
+	// STPCancelOldest cancels the resting order.
+	STPCancelOldest STP = 1
+
+	// STPCancelBoth cancels both orders.
+	STPCancelBoth STP = 2
+
+	// STPDecrement reduces both orders by the smaller volume.
+	STPDecrement STP = 3
 )
 
 type Status int
@@ -50,4 +120,6 @@ const (
 	StatusPosted     Status = 2
 	StatusCancelling Status = 4
 	StatusComplete   Status = 5
+	StatusExpiring   Status = 6
+	StatusAmending   Status = 7
 )
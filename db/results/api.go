@@ -11,7 +11,11 @@ import (
 
 const Cursor = "results"
 
-func Create(ctx context.Context, dbc *sql.DB, rl []matcher.Result) (int64, error) {
+// Create stores the market's results with the next sequence of the
+// market's results.
+func Create(ctx context.Context, dbc *sql.DB, market string, marketSeq int64,
+	rl []matcher.Result) (int64, error) {
+
 	var (
 		q    strings.Builder
 		args []interface{}
@@ -22,21 +26,34 @@ func Create(ctx context.Context, dbc *sql.DB, rl []matcher.Result) (int64, error
 		return 0, err
 	}
 
-	var start, end int64
+	var (
+		start, end int64
+		hash       string
+	)
 	if len(rl) > 0 {
 		start = rl[0].Sequence
 		end = rl[len(rl)-1].Sequence
+		hash = rl[len(rl)-1].Hash
 	}
 
 	q.WriteString("insert into results set `created_at`=? ")
 	args = append(args, time.Now())
 
+	q.WriteString(", `market`=?")
+	args = append(args, market)
+
+	q.WriteString(", `market_seq`=?")
+	args = append(args, marketSeq)
+
 	q.WriteString(", `start_seq`=?")
 	args = append(args, start)
 
 	q.WriteString(", `end_seq`=?")
 	args = append(args, end)
 
+	q.WriteString(", `hash`=?")
+	args = append(args, hash)
+
 	q.WriteString(", `results_json`=?")
 	args = append(args, b)
 
@@ -74,6 +91,22 @@ func LookupLast(ctx context.Context, dbc *sql.DB) (*Result, error) {
 	return lookupWhere(ctx, dbc, "true order by id desc limit 1")
 }
 
+// LookupLastInMarket returns the last results of the market.
+func LookupLastInMarket(ctx context.Context, dbc *sql.DB, market string) (*Result, error) {
+	return lookupWhere(ctx, dbc, "market=? order by market_seq desc limit 1", market)
+}
+
 func ListAll(ctx context.Context, dbc *sql.DB) ([]Result, error) {
 	return listWhere(ctx, dbc, "true")
 }
+
+// ListInMarket returns all results of the market in order.
+func ListInMarket(ctx context.Context, dbc *sql.DB, market string) ([]Result, error) {
+	return listWhere(ctx, dbc, "market=? order by market_seq", market)
+}
+
+// ListInMarketAfter returns the results of the market including results
+// after the sequence in order.
+func ListInMarketAfter(ctx context.Context, dbc *sql.DB, market string, seq int64) ([]Result, error) {
+	return listWhere(ctx, dbc, "market=? and end_seq>? order by market_seq", market, seq)
+}
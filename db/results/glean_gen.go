@@ -8,7 +8,7 @@ import (
 	"time"
 )
 
-const cols = " `id`, `start_seq`, `end_seq`, `created_at`, `results_json` "
+const cols = " `id`, `market`, `market_seq`, `start_seq`, `end_seq`, `created_at`, `hash`, `results_json` "
 const selectPrefix = "select " + cols + " from results where "
 
 var _ time.Time
@@ -48,7 +48,7 @@ func listWhere(ctx context.Context, dbc dbc, where string, args ...interface{})
 func scan(row row) (*Result, error) {
 	var g glean
 
-	err := row.Scan(&g.ID, &g.StartSeq, &g.EndSeq, &g.CreatedAt, &g.Results)
+	err := row.Scan(&g.ID, &g.Market, &g.MarketSeq, &g.StartSeq, &g.EndSeq, &g.CreatedAt, &g.Hash, &g.Results)
 	if err != nil {
 		return nil, err
 	}
@@ -60,9 +60,12 @@ func scan(row row) (*Result, error) {
 
 	return &Result{
 		ID:        g.ID,
+		Market:    g.Market,
+		MarketSeq: g.MarketSeq,
 		StartSeq:  g.StartSeq,
 		EndSeq:    g.EndSeq,
 		CreatedAt: g.CreatedAt,
+		Hash:      g.Hash,
 		Results:   results,
 	}, nil
 }
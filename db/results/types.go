@@ -7,8 +7,11 @@ import (
 
 type Result struct {
 	ID        int64
+	Market    string
+	MarketSeq int64 // Sequence of the results in the market.
 	StartSeq  int64
 	EndSeq    int64
 	CreatedAt time.Time
+	Hash      string // Rolling hash of the last result
 	Results   []matcher.Result
 }
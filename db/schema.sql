@@ -18,6 +18,8 @@ create table order_events (
 
 create table orders (
   id bigint not null auto_increment,
+  market varchar(32) not null,
+  account_id bigint not null,
   type int not null,
   is_buy bool not null,
   status int not null,
@@ -29,12 +31,24 @@ create table orders (
   limit_volume decimal(29,18),
   market_base decimal(29,18),
   market_counter decimal(29,18),
+  worst_price decimal(29,18),
+  max_slippage decimal(29,18),
+  stop_price decimal(29,18),
+  time_in_force int not null,
+  stp int not null,
+  expires_at datetime(3) null,
+  display_volume decimal(29,18),
+  slide bool not null,
+  amend_price decimal(29,18) null,
+  amend_volume decimal(29,18) null,
 
-  primary key (id)
+  primary key (id),
+  index by_status_expires (status, expires_at)
 );
 
 create table trades (
   id bigint not null auto_increment,
+  market varchar(32) not null,
   seq bigint not null,
   seq_idx int not null,
   is_buy bool not null,
@@ -43,6 +57,8 @@ create table trades (
   taker_order_id bigint not null,
   price decimal(29,18),
   volume decimal(29,18),
+  maker_fee decimal(29,18) not null,
+  taker_fee decimal(29,18) not null,
 
   primary key (id),
   unique uniq_seq (seq, seq_idx)
@@ -50,12 +66,16 @@ create table trades (
 
 create table results (
   id bigint not null auto_increment,
+  market varchar(32) not null,
+  market_seq bigint not null,
   start_seq bigint not null,
   end_seq bigint not null,
   created_at datetime(3) not null,
+  hash char(64) not null,
   results_json blob,
 
-  primary key (id)
+  primary key (id),
+  unique uniq_market_seq (market, market_seq)
 );
 
 create table result_events (
@@ -66,3 +86,15 @@ create table result_events (
 
   primary key (id)
 );
+
+create table snapshots (
+  id bigint not null auto_increment,
+  market varchar(32) not null,
+  seq bigint not null,
+  created_at datetime(3) not null,
+  checksum varchar(64) not null,
+  book_json mediumblob,
+
+  primary key (id),
+  index by_market_seq (market, seq)
+);
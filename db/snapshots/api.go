@@ -0,0 +1,120 @@
+package snapshots
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/corverroos/exchange/matcher"
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/j"
+	"github.com/luno/jettison/log"
+)
+
+// Create stores a snapshot of the market's order book.
+func Create(ctx context.Context, dbc *sql.DB, market string, snap matcher.Snapshot) (int64, error) {
+	var (
+		q    strings.Builder
+		args []interface{}
+	)
+
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return 0, err
+	}
+
+	q.WriteString("insert into snapshots set `created_at`=? ")
+	args = append(args, time.Now())
+
+	q.WriteString(", `market`=?")
+	args = append(args, market)
+
+	q.WriteString(", `seq`=?")
+	args = append(args, snap.Sequence())
+
+	q.WriteString(", `checksum`=?")
+	args = append(args, checksum(b))
+
+	q.WriteString(", `book_json`=?")
+	args = append(args, b)
+
+	res, err := dbc.ExecContext(ctx, q.String(), args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.LastInsertId()
+}
+
+// LookupLatest returns the market's order book of the latest valid snapshot
+// at or before the sequence. Corrupt snapshots are skipped. It returns
+// sql.ErrNoRows if no valid snapshot exists.
+func LookupLatest(ctx context.Context, dbc *sql.DB, market string, seq int64) (matcher.OrderBook, error) {
+	sl, err := listWhere(ctx, dbc, "market=? and seq<=? order by seq desc, id desc", market, seq)
+	if err != nil {
+		return matcher.OrderBook{}, err
+	}
+
+	for _, s := range sl {
+		book, err := s.toBook()
+		if err != nil {
+			log.Error(ctx, errors.Wrap(err, "skipping corrupt snapshot",
+				j.MKV{"id": s.ID, "seq": s.Seq}))
+			continue
+		}
+
+		return book, nil
+	}
+
+	return matcher.OrderBook{}, sql.ErrNoRows
+}
+
+// DeleteAllButLast deletes all but the last keep snapshots of the market.
+func DeleteAllButLast(ctx context.Context, dbc *sql.DB, market string, keep int) error {
+	if keep < 1 {
+		return errors.New("must keep at least one snapshot")
+	}
+
+	var id int64
+	err := dbc.QueryRowContext(ctx, "select id from snapshots where market=? "+
+		"order by id desc limit 1 offset ?", market, keep-1).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Not enough snapshots.
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	_, err = dbc.ExecContext(ctx, "delete from snapshots where market=? and id<?", market, id)
+	return err
+}
+
+// toBook returns the snapshot's order book or an error if
+// the checksum doesn't match.
+func (s Snapshot) toBook() (matcher.OrderBook, error) {
+	var book matcher.OrderBook
+
+	if checksum(s.BookJSON) != s.Checksum {
+		return book, errors.New("snapshot checksum mismatch")
+	}
+
+	err := json.Unmarshal(s.BookJSON, &book)
+	if err != nil {
+		return book, err
+	}
+
+	if book.Sequence != s.Seq {
+		return book, errors.New("snapshot sequence mismatch")
+	}
+
+	return book, nil
+}
+
+func checksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
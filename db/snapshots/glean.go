@@ -0,0 +1,7 @@
+package snapshots
+
+//go:generate glean -table=snapshots
+
+type glean struct {
+	Snapshot
+}
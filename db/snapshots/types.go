@@ -0,0 +1,14 @@
+package snapshots
+
+import (
+	"time"
+)
+
+type Snapshot struct {
+	ID        int64
+	Market    string
+	Seq       int64 // Sequence of the order book.
+	CreatedAt time.Time
+	Checksum  string // Hex encoded sha256 of BookJSON.
+	BookJSON  []byte
+}
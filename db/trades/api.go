@@ -6,10 +6,17 @@ import (
 	"strings"
 	"time"
 
+	"github.com/go-sql-driver/mysql"
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/j"
 	"github.com/shopspring/decimal"
 )
 
+// ErrDuplicate indicates a trade of the sequence and index already exists.
+var ErrDuplicate = errors.New("duplicate trade", j.C("ERR_919060ade748be27"))
+
 type CreateReq struct {
+	Market       string
 	IsBuy        bool
 	Seq          int64
 	SeqIdx       int
@@ -17,8 +24,12 @@ type CreateReq struct {
 	Volume       decimal.Decimal
 	MakerOrderID int64
 	TakerOrderID int64
+	MakerFee     decimal.Decimal
+	TakerFee     decimal.Decimal
 }
 
+// Create stores the trade. It returns ErrDuplicate if the trade of the
+// sequence and index already exists.
 func Create(ctx context.Context, dbc *sql.DB, req CreateReq) (int64, error) {
 	var (
 		q    strings.Builder
@@ -28,6 +39,9 @@ func Create(ctx context.Context, dbc *sql.DB, req CreateReq) (int64, error) {
 	q.WriteString("insert into trades set `created_at`=? ")
 	args = append(args, time.Now())
 
+	q.WriteString(", `market`=?")
+	args = append(args, req.Market)
+
 	q.WriteString(", `is_buy`=?")
 	args = append(args, req.IsBuy)
 
@@ -49,8 +63,17 @@ func Create(ctx context.Context, dbc *sql.DB, req CreateReq) (int64, error) {
 	q.WriteString(", `taker_order_id`=?")
 	args = append(args, req.TakerOrderID)
 
+	q.WriteString(", `maker_fee`=?")
+	args = append(args, req.MakerFee)
+
+	q.WriteString(", `taker_fee`=?")
+	args = append(args, req.TakerFee)
+
 	res, err := dbc.ExecContext(ctx, q.String(), args...)
-	if err != nil {
+	if isDuplicate(err) {
+		return 0, errors.Wrap(ErrDuplicate, "",
+			j.MKV{"seq": req.Seq, "seq_idx": req.SeqIdx})
+	} else if err != nil {
 		return 0, err
 	}
 	id, err := res.LastInsertId()
@@ -60,3 +83,15 @@ func Create(ctx context.Context, dbc *sql.DB, req CreateReq) (int64, error) {
 
 	return id, nil
 }
+
+// ListAll returns all trades in order.
+func ListAll(ctx context.Context, dbc *sql.DB) ([]Trade, error) {
+	return listWhere(ctx, dbc, "true order by id")
+}
+
+// isDuplicate returns true if the error is a MySQL duplicate entry error
+// (ER_DUP_ENTRY).
+func isDuplicate(err error) bool {
+	var me *mysql.MySQLError
+	return errors.As(err, &me) && me.Number == 1062
+}
@@ -7,7 +7,7 @@ import (
 	"database/sql"
 )
 
-const cols = " `id`, `seq`, `seq_idx`, `price`, `volume`, `maker_order_id`, `taker_order_id`, `created_at` "
+const cols = " `id`, `market`, `seq`, `seq_idx`, `price`, `volume`, `maker_order_id`, `taker_order_id`, `maker_fee`, `taker_fee`, `created_at` "
 const selectPrefix = "select " + cols + " from trades where "
 
 func Lookup(ctx context.Context, dbc dbc, id int64) (*Trade, error) {
@@ -45,19 +45,22 @@ func listWhere(ctx context.Context, dbc dbc, where string, args ...interface{})
 func scan(row row) (*Trade, error) {
 	var g glean
 
-	err := row.Scan(&g.ID, &g.Seq, &g.SeqIdx, &g.Price, &g.Volume, &g.MakerOrderID, &g.TakerOrderID, &g.CreatedAt)
+	err := row.Scan(&g.ID, &g.Market, &g.Seq, &g.SeqIdx, &g.Price, &g.Volume, &g.MakerOrderID, &g.TakerOrderID, &g.MakerFee, &g.TakerFee, &g.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Trade{
 		ID:           g.ID,
+		Market:       g.Market,
 		Seq:          g.Seq,
 		SeqIdx:       g.SeqIdx,
 		Price:        g.Price,
 		Volume:       g.Volume,
 		MakerOrderID: g.MakerOrderID,
 		TakerOrderID: g.TakerOrderID,
+		MakerFee:     g.MakerFee,
+		TakerFee:     g.TakerFee,
 		CreatedAt:    g.CreatedAt,
 	}, nil
 }
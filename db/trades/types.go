@@ -8,6 +8,7 @@ import (
 
 type Trade struct {
 	ID           int64
+	Market       string
 	IsBuy        bool
 	Seq          int64 // Sequence of the matcher command producing this trade.
 	SeqIdx       int   // Index of this trade in the sequence's set of trades.
@@ -15,5 +16,7 @@ type Trade struct {
 	Volume       decimal.Decimal
 	MakerOrderID int64
 	TakerOrderID int64
+	MakerFee     decimal.Decimal // Fee of the maker's base amount, negative for rebates.
+	TakerFee     decimal.Decimal // Fee of the taker's base amount.
 	CreatedAt    time.Time
 }
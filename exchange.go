@@ -7,7 +7,9 @@ import (
 	"github.com/corverroos/exchange/db/cursors"
 	"github.com/corverroos/exchange/db/orders"
 	"github.com/corverroos/exchange/db/results"
+	"github.com/corverroos/exchange/db/snapshots"
 	"github.com/corverroos/exchange/db/trades"
+	"github.com/corverroos/exchange/markets"
 	"github.com/corverroos/exchange/matcher"
 	"strconv"
 	"sync"
@@ -16,32 +18,158 @@ import (
 	"github.com/luno/fate"
 	"github.com/luno/jettison/errors"
 	"github.com/luno/jettison/j"
+	"github.com/luno/jettison/log"
 	"github.com/luno/reflex"
-	"github.com/luno/reflex/rpatterns"
+	"github.com/luno/shift"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/shopspring/decimal"
 )
 
-// Run runs the exchange returning the first error.
+// Run runs a matcher for each market until the context is done. It
+// returns an error if a market isn't registered or its config is invalid,
+// see WithMarketsFile to register markets at startup. Each market has its own
+// order book, cursor and results. Order events are streamed once and routed
+// to the markets. A market matcher that errors is logged and restarted
+// without affecting the other markets.
 func Run(ctx context.Context, dbc *sql.DB, opts ...Option) error {
+	o := options{
+		snap:          func(*matcher.OrderBook) {},
+		countInc:      func() {},
+		mLatency:      func() func() { return func() {} },
+		maxBatch:      100,
+		snapEvery:     10000,
+		snapPeriod:    10 * time.Minute,
+		snapKeep:      3,
+		restartPeriod: time.Second,
+	}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.marketsFile != "" {
+		cl, err := markets.Read(o.marketsFile)
+		if err != nil {
+			return err
+		}
+
+		markets.Register(cl...)
+
+		if len(o.markets) == 0 {
+			for _, c := range cl {
+				o.markets = append(o.markets, c.Market)
+			}
+		}
+	}
+
+	if len(o.markets) == 0 {
+		o.markets = []string{orders.DefaultMarket}
+	}
+
+	cfgs := make(map[string]markets.Config)
+	for _, market := range o.markets {
+		cfg, err := markets.Lookup(market)
+		if err != nil {
+			return err
+		}
+
+		// Registered configs aren't validated.
+		if err := cfg.Validate(); err != nil {
+			return err
+		}
+
+		cfgs[market] = cfg
+	}
+
+	var err error
+	o.prom, err = o.collector()
+	if err != nil {
+		return err
+	} else if o.prom != nil && o.tracer == nil {
+		// Stage latencies require tracing.
+		o.tracer = NewTracer(defaultTraceLimit)
+	}
+
+	r := newRouter(orders.ToStream(dbc))
+
+	// restart calls f until the context is done, logging errors.
+	restart := func(f func() error) {
+		for {
+			err := f()
+			if ctx.Err() != nil {
+				return
+			}
+
+			log.Error(ctx, err)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(o.restartPeriod):
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for market, cfg := range cfgs {
+		wg.Add(1)
+		go func(market string, cfg markets.Config) {
+			defer wg.Done()
+			restart(func() error {
+				err := runMarket(ctx, dbc, r, market, cfg, o)
+				return errors.Wrap(err, "market matcher error",
+					j.KV("market", market))
+			})
+		}(market, cfg)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		restart(func() error {
+			return errors.Wrap(r.Run(ctx), "order events router error")
+		})
+	}()
+
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+// runMarket runs the market's matcher returning the first error. The
+// router routes the market's commands to the matcher once its order book
+// is built.
+func runMarket(ctx context.Context, dbc *sql.DB, r *router, market string,
+	cfg markets.Config, o options) error {
+
+	// Stop all go routines when done.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	s := &state{
 		dbc:       dbc,
+		market:    market,
 		input:     make(chan matcher.Command, 1000),
 		output:    make(chan matcher.Result, 1000),
-		snap:      func(*matcher.OrderBook) {},
-		baseScale: 8,
-		countInc:  func() {},
-		mLatency:  func() func() { return func() {} },
-		maxBatch:  100,
+		snapshots: newSnapshotter(market, o.snapEvery, o.snapPeriod, o.snapKeep),
+		options:   o,
 	}
 
-	for _, opt := range opts {
-		opt(s)
+	if o.metrics != nil {
+		o.metrics.setQueues(market, func() int {
+			return len(s.input)
+		}, func() int {
+			return len(s.output)
+		})
 	}
-
-	cs := cursors.ToStore(dbc)
-	name := "matcher"
+	o.prom.setQueues(market, func() int {
+		return len(s.input)
+	}, func() int {
+		return len(s.output)
+	})
 
 	// Get current cursor (sequence)
-	cursor, err := cs.GetCursor(ctx, name)
+	cursor, err := cursors.ToStore(dbc).GetCursor(ctx, cursorName(market))
 	if err != nil {
 		return err
 	}
@@ -54,21 +182,32 @@ func Run(ctx context.Context, dbc *sql.DB, opts ...Option) error {
 			return err
 		}
 
-		book, err = buildOrderBook(ctx, dbc, seq)
+		book, err = buildOrderBook(ctx, dbc, market, seq, cfg)
 		if err != nil {
 			return err
 		}
+
+		// Only enqueue events after the cursor.
+		s.sent = seq
+		s.snapshots.lastSeq = seq
 	}
 
-	// Reflex enqueues input from order events
-	ac := rpatterns.NewAckConsumer(name, cs, s.Enqueue)
-	spec := rpatterns.NewAckSpec(orders.ToStream(dbc), ac)
+	// Continue the market's results sequence.
+	last, err := results.LookupLastInMarket(ctx, dbc, market)
+	if errors.Is(err, sql.ErrNoRows) {
+		// No results yet.
+	} else if err != nil {
+		return err
+	} else {
+		s.resultSeq = last.MarketSeq
+	}
 
-	// Start the input, matcher and output go routines, exit on first error.
+	// Start the router, matcher, output and snapshot go routines, exit on
+	// first error.
 	select {
 	case err = <-goChan(func() error {
-		// Reflex errors don't affect state, could actually just retry.
-		return reflex.Run(ctx, spec)
+		// Route the market's commands to the matcher.
+		return r.Follow(ctx, s)
 	}):
 	case err = <-goChan(func() error {
 		// State stores results. Errors restart matching since
@@ -76,51 +215,144 @@ func Run(ctx context.Context, dbc *sql.DB, opts ...Option) error {
 		return s.StoreResults(ctx)
 	}):
 	case err = <-goChan(func() error {
+		// Snapshot errors are logged, only returns on ctx done.
+		return s.snapshots.Store(ctx, dbc)
+	}):
+	case err = <-goChan(func() error {
+		snap := func(book *matcher.OrderBook) {
+			s.snap(book)
+			s.snapshots.Maybe(book)
+		}
+
 		// Match errors indicate bigger problems.
 		return matcher.Match(ctx, book, s.input, s.output,
-			s.baseScale, s.snap, s.mLatency)
+			cfg, snap, s.prom.latency(market, s.mLatency))
 	}):
 	}
 
 	return err
 }
 
-type Option func(*state)
+// cursorName returns the name of the market's matcher cursor. The default
+// market uses the original single market cursor name.
+func cursorName(market string) string {
+	if market == orders.DefaultMarket {
+		return "matcher"
+	}
+	return "matcher_" + market
+}
+
+type Option func(*options)
 
+// WithSnap returns an option to call the function with the order book after
+// each command. Note that book.Depth excludes hidden iceberg volume and
+// should be used for public market data. When running multiple markets,
+// the function is called concurrently by each market's matcher.
 func WithSnap(f func(book *matcher.OrderBook)) Option {
-	return func(s *state) {
-		s.snap = f
+	return func(o *options) {
+		o.snap = f
+	}
+}
+
+// WithSnapshots overrides the default order book snapshot config. Snapshots
+// are stored every N commands or T duration, whichever comes first, and only
+// the last K snapshots are kept. Zero every and period disables snapshots.
+func WithSnapshots(every int64, period time.Duration, keep int) Option {
+	return func(o *options) {
+		o.snapEvery = every
+		o.snapPeriod = period
+		o.snapKeep = keep
+	}
+}
+
+// WithMarkets returns an option to run matchers for the provided markets
+// instead of only orders.DefaultMarket.
+func WithMarkets(markets ...string) Option {
+	return func(o *options) {
+		o.markets = markets
+	}
+}
+
+// WithMarketsFile returns an option to load and register the market configs
+// of the YAML file (see markets.Load) when starting. Matchers are run for
+// the loaded markets unless WithMarkets is also provided.
+func WithMarketsFile(path string) Option {
+	return func(o *options) {
+		o.marketsFile = path
+	}
+}
+
+// WithRegistry returns an option to register the prometheus metrics of
+// the exchange pipeline with the registry.
+func WithRegistry(reg prometheus.Registerer) Option {
+	return func(o *options) {
+		o.registry = reg
+	}
+}
+
+// WithTracer returns an option to record the traces of order commands
+// through the pipeline. Provide the same tracer to Run and ConsumeResults
+// to trace the whole pipeline.
+func WithTracer(t *Tracer) Option {
+	return func(o *options) {
+		o.tracer = t
 	}
 }
 
 func WithMetrics(m *Metrics) Option {
-	return func(s *state) {
-		s.countInc = m.incCount
-		s.mLatency = m.latency
-		m.getOutput = func() int {
-			return len(s.output)
-		}
-		m.getInput = func() int {
-			return len(s.input)
-		}
+	return func(o *options) {
+		o.metrics = m
+		o.countInc = m.incCount
+		o.mLatency = m.latency
 	}
 }
 
-// state encapsulated the exchange matcher state.
+// options configures the exchange matchers.
+type options struct {
+	snap        func(*matcher.OrderBook)
+	markets     []string
+	marketsFile string
+	metrics     *Metrics
+	registry    prometheus.Registerer
+	prom        *collector
+	tracer      *Tracer
+
+	snapEvery  int64
+	snapPeriod time.Duration
+	snapKeep   int
+
+	countInc      func()
+	mLatency      func() func()
+	maxBatch      int
+	restartPeriod time.Duration
+}
+
+// collector returns the prometheus collector registered with the
+// registry or nil if no registry is configured.
+func (o options) collector() (*collector, error) {
+	if o.registry == nil {
+		return nil, nil
+	}
+	return register(o.registry)
+}
+
+// state encapsulated the exchange matcher state of a market.
 type state struct {
+	options
+
 	dbc    *sql.DB
+	market string
 	input  chan matcher.Command
 	output chan matcher.Result
-	snap   func(*matcher.OrderBook)
 
-	mu      sync.Mutex
-	acks    []*rpatterns.AckEvent
-	lastAck int64
+	mu   sync.Mutex
+	acks []*reflex.Event
+	sent int64 // Last sequence sent to the matcher including noops.
 
-	baseScale int
-	countInc  func()
-	mLatency  func() func()
-	maxBatch  int
+	// resultSeq is the sequence of the market's last stored results.
+	resultSeq int64
+
+	snapshots *snapshotter
 }
 
 func (s *state) StoreResults(ctx context.Context) error {
@@ -142,6 +374,9 @@ func (s *state) StoreResults(ctx context.Context) error {
 				break
 			} else if !popped && len(rl) == 0 {
 				// Nothing available yet, wait a bit.
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
 				time.Sleep(time.Millisecond)
 				continue
 			} else if popped && len(rl) >= s.maxBatch {
@@ -155,7 +390,7 @@ func (s *state) StoreResults(ctx context.Context) error {
 
 		var (
 			toStore []matcher.Result
-			toAck   *rpatterns.AckEvent
+			toAck   *reflex.Event
 		)
 		for _, r := range rl {
 			if r.Type == matcher.TypeCommandUnknown {
@@ -164,6 +399,10 @@ func (s *state) StoreResults(ctx context.Context) error {
 			}
 			s.countInc() // Do not include noops in "count" metrics.
 
+			if d, ok := s.tracer.matched(r.Sequence, r.MatchedAt); ok {
+				s.prom.observeStage(stageMatch, d)
+			}
+
 			s.mu.Lock()
 			e := s.acks[0]
 			s.acks = s.acks[1:]
@@ -184,74 +423,271 @@ func (s *state) StoreResults(ctx context.Context) error {
 			continue
 		}
 
-		_, err := results.Create(ctx, s.dbc, toStore)
+		t0 := time.Now()
+		_, err := results.Create(ctx, s.dbc, s.market, s.resultSeq+1, toStore)
 		if err != nil {
 			return err
 		}
+		s.resultSeq++
+		s.prom.observeBatch(s.market, toStore, time.Since(t0))
 
-		err = toAck.Ack(ctx)
+		now := time.Now()
+		for _, r := range toStore {
+			if d, ok := s.tracer.stored(r.Sequence, now); ok {
+				s.prom.observeStage(stageStore, d)
+			}
+		}
+
+		err = s.ack(ctx, toAck)
 		if err != nil {
 			return err
 		}
 	}
 }
 
-func (s *state) Enqueue(ctx context.Context, fate fate.Fate, e *rpatterns.AckEvent) error {
-	var (
-		cmd matcher.Command
-		err error
-	)
-	if reflex.IsType(e.Type, orders.StatusPending) {
-		cmd, err = makeCreate(e)
-	} else if reflex.IsType(e.Type, orders.StatusCancelling) {
-		cmd, err = makeCancel(e)
-	} else {
-		// We only care about pending and cancelling states.
-		return nil
-	}
+// ack stores the event ID as the market's cursor.
+func (s *state) ack(ctx context.Context, e *reflex.Event) error {
+	cs := cursors.ToStore(s.dbc)
+
+	err := cs.SetCursor(ctx, cursorName(s.market), e.ID)
 	if err != nil {
 		return err
 	}
 
-	seq := e.IDInt()
+	return cs.Flush(ctx)
+}
 
+// lastSent returns the last sequence sent to the matcher.
+func (s *state) lastSent() int64 {
 	s.mu.Lock()
-	if s.lastAck >= seq {
+	defer s.mu.Unlock()
+
+	return s.sent
+}
+
+// Enqueue sends the market's command of the order event to the matcher.
+// It returns nil without sending if the event was already enqueued. If
+// wait is false, it returns errInputFull instead of blocking when the
+// matcher's input is full; the event may then be enqueued again.
+func (s *state) Enqueue(ctx context.Context, e *reflex.Event,
+	cmd matcher.Command, wait bool) error {
+
+	s.prom.observeLag(cursorName(s.market), e)
+
+	seq := e.IDInt()
+	if s.lastSent() >= seq {
 		// Event already enqueued.
-		s.mu.Unlock()
 		return nil
 	}
-	prevSeq := s.lastAck
-	s.lastAck = seq
+
+	// Other markets' events are routed elsewhere, but matcher requires
+	// sequential commands.
+	for i := s.lastSent() + 1; i < seq; i++ {
+		if err := s.send(ctx, matcher.Command{Sequence: i}, wait); err != nil {
+			return err
+		}
+	}
+
+	// Results are acked in order, so add the event before sending.
+	s.mu.Lock()
 	s.acks = append(s.acks, e)
 	s.mu.Unlock()
 
-	// Reflex filters noops, but matcher requires sequential commands
-	for i := prevSeq + 1; i < seq; i++ {
-		s.input <- matcher.Command{Sequence: i}
+	if err := s.send(ctx, cmd, wait); err != nil {
+		s.mu.Lock()
+		s.acks = s.acks[:len(s.acks)-1]
+		s.mu.Unlock()
+		return err
+	}
+
+	d := s.tracer.enqueued(seq, cmd.OrderID, e.Timestamp, time.Now())
+	s.prom.observeStage(stageEnqueue, d)
+
+	return nil
+}
+
+// send sends the command to the matcher and updates the last sent
+// sequence. It returns errInputFull if wait is false and the matcher's
+// input is full.
+func (s *state) send(ctx context.Context, cmd matcher.Command, wait bool) error {
+	if wait {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case s.input <- cmd:
+		}
+	} else {
+		select {
+		case s.input <- cmd:
+		default:
+			return errInputFull
+		}
 	}
 
-	s.input <- cmd
+	s.mu.Lock()
+	s.sent = cmd.Sequence
+	s.mu.Unlock()
 
 	return nil
 }
 
-func makeCancel(e *rpatterns.AckEvent) (matcher.Command, error) {
-	var isBuy bool
-	err := json.Unmarshal(e.MetaData, &isBuy)
+// makeCommand returns the matcher command for the order event and true
+// or false if the event is not a matcher command. Events that can't be
+// converted return an invalid command of the event's market and the
+// conversion error, so that only that market's error policy applies.
+func makeCommand(e *reflex.Event) (matcher.Command, bool, error) {
+	var (
+		cmd     matcher.Command
+		control bool
+		err     error
+	)
+	if reflex.IsType(e.Type, orders.StatusPending) {
+		cmd, err = makeCreate(e)
+	} else if reflex.IsType(e.Type, orders.StatusCancelling) {
+		cmd, err = makeCancel(e, matcher.CommandCancel)
+	} else if reflex.IsType(e.Type, orders.StatusExpiring) {
+		cmd, err = makeCancel(e, matcher.CommandExpire)
+	} else if reflex.IsType(e.Type, orders.StatusAmending) {
+		cmd, err = makeAmend(e)
+	} else if reflex.IsType(e.Type, orders.ControlAuctionStart) {
+		cmd, err = makeControl(e, matcher.CommandAuctionStart)
+		control = true
+	} else if reflex.IsType(e.Type, orders.ControlUncross) {
+		cmd, err = makeControl(e, matcher.CommandUncross)
+		control = true
+	} else if reflex.IsType(e.Type, orders.ControlHalt) {
+		cmd, err = makeControl(e, matcher.CommandHalt)
+		control = true
+	} else if reflex.IsType(e.Type, orders.ControlResume) {
+		cmd, err = makeControl(e, matcher.CommandResume)
+		control = true
+	} else if reflex.IsType(e.Type, orders.ControlMassCancel) {
+		cmd, err = makeControl(e, matcher.CommandMassCancel)
+		control = true
+	} else {
+		// We only care about pending, cancelling, expiring and amending
+		// states and control events.
+		return matcher.Command{}, false, nil
+	}
+	if err != nil {
+		return makeInvalid(e, control), true, err
+	}
+
+	// The event time drives the circuit breaker deterministically.
+	cmd.Timestamp = e.Timestamp
+
+	return cmd, true, nil
+}
+
+// makeInvalid returns an invalid command of the order event's market. The
+// market defaults to the default market if the metadata doesn't include it.
+// Control events have no order.
+func makeInvalid(e *reflex.Event, control bool) matcher.Command {
+	var meta struct {
+		Market string
+	}
+	_ = json.Unmarshal(e.MetaData, &meta)
+
+	cmd := matcher.Command{
+		Sequence:  e.IDInt(),
+		Type:      matcher.CommandInvalid,
+		Market:    meta.Market,
+		Timestamp: e.Timestamp,
+	}
+	if !control {
+		cmd.OrderID = e.ForeignIDInt()
+	}
+
+	return cmd
+}
+
+// makeCancel returns a command of the type that removes the order from
+// the book.
+func makeCancel(e *reflex.Event, typ matcher.CommandType) (matcher.Command, error) {
+	var meta orders.CancelMetadata
+	err := json.Unmarshal(e.MetaData, &meta)
+	if err != nil {
+		// Events before multi-market support only contain isBuy.
+		err = json.Unmarshal(e.MetaData, &meta.IsBuy)
+	}
 	if err != nil {
 		return matcher.Command{}, err
 	}
 
 	return matcher.Command{
 		Sequence: e.IDInt(),
-		Type:     matcher.CommandCancel,
-		IsBuy:    isBuy,
+		Type:     typ,
+		IsBuy:    meta.IsBuy,
 		OrderID:  e.ForeignIDInt(),
+		Market:   meta.Market,
+	}, nil
+}
+
+// makeControl returns a market control command of the type.
+func makeControl(e *reflex.Event, typ matcher.CommandType) (matcher.Command, error) {
+	var meta orders.ControlMetadata
+	err := json.Unmarshal(e.MetaData, &meta)
+	if err != nil {
+		return matcher.Command{}, err
+	}
+
+	cmd := matcher.Command{
+		Sequence: e.IDInt(),
+		Type:     typ,
+		Market:   meta.Market,
+	}
+
+	if meta.Filter != nil {
+		side, err := makeSide(meta.Filter.Side)
+		if err != nil {
+			return matcher.Command{}, err
+		}
+
+		cmd.Filter = &matcher.CancelFilter{
+			AccountID: meta.Filter.AccountID,
+			Side:      side,
+			MinPrice:  meta.Filter.MinPrice,
+			MaxPrice:  meta.Filter.MaxPrice,
+		}
+	}
+
+	return cmd, nil
+}
+
+func makeSide(side orders.CancelSide) (matcher.Side, error) {
+	switch side {
+	case orders.CancelBoth:
+		return matcher.SideBoth, nil
+	case orders.CancelBids:
+		return matcher.SideBid, nil
+	case orders.CancelAsks:
+		return matcher.SideAsk, nil
+	default:
+		return 0, errors.New("unsupported cancel side",
+			j.KV("side", side))
+	}
+}
+
+func makeAmend(e *reflex.Event) (matcher.Command, error) {
+	var meta orders.AmendMetadata
+	err := json.Unmarshal(e.MetaData, &meta)
+	if err != nil {
+		return matcher.Command{}, err
+	}
+
+	return matcher.Command{
+		Sequence:    e.IDInt(),
+		Type:        matcher.CommandAmend,
+		IsBuy:       meta.IsBuy,
+		OrderID:     e.ForeignIDInt(),
+		Market:      meta.Market,
+		LimitPrice:  meta.Price,
+		LimitVolume: meta.Volume,
+		VolumeDelta: meta.VolumeDelta,
 	}, nil
 }
 
-func makeCreate(e *rpatterns.AckEvent) (matcher.Command, error) {
+func makeCreate(e *reflex.Event) (matcher.Command, error) {
 	var req orders.CreateReq
 	err := json.Unmarshal(e.MetaData, &req)
 	if err != nil {
@@ -265,25 +701,171 @@ func makeCreate(e *rpatterns.AckEvent) (matcher.Command, error) {
 		typ = matcher.CommandPostOnly
 	} else if req.Type == orders.TypeLimit {
 		typ = matcher.CommandLimit
+	} else if req.Type == orders.TypeStop {
+		typ = matcher.CommandStop
+	} else if req.Type == orders.TypeStopLimit {
+		typ = matcher.CommandStopLimit
 	} else {
 		return matcher.Command{}, errors.New("unsupported order type/status",
 			j.KV("id", e.ForeignIDInt()))
 	}
 
+	tif, err := makeTimeInForce(req.TimeInForce)
+	if err != nil {
+		return matcher.Command{}, err
+	}
+
+	stp, err := makeSTP(req.STP)
+	if err != nil {
+		return matcher.Command{}, err
+	}
+
 	return matcher.Command{
 		Sequence:      e.IDInt(),
 		Type:          typ,
 		IsBuy:         req.IsBuy,
 		OrderID:       e.ForeignIDInt(),
+		Market:        req.Market,
 		LimitPrice:    req.LimitPrice,
 		LimitVolume:   req.LimitVolume,
 		MarketBase:    req.MarketBase,
 		MarketCounter: req.MarketCounter,
+		WorstPrice:    req.WorstPrice,
+		MaxSlippage:   req.MaxSlippage,
+		StopPrice:     req.StopPrice,
+		TimeInForce:   tif,
+		LimitDisplay:  req.DisplayVolume,
+		Slide:         req.Slide,
+		AccountID:     req.AccountID,
+		STP:           stp,
 	}, nil
 }
 
-func buildOrderBook(ctx context.Context, db *sql.DB, seq int64) (matcher.OrderBook, error) {
-	return matcher.OrderBook{}, errors.New("buildOrderBook not implemented")
+func makeTimeInForce(tif orders.TimeInForce) (matcher.TimeInForce, error) {
+	switch tif {
+	case orders.TimeInForceGTC:
+		return matcher.TimeInForceGTC, nil
+	case orders.TimeInForceIOC:
+		return matcher.TimeInForceIOC, nil
+	case orders.TimeInForceFOK:
+		return matcher.TimeInForceFOK, nil
+	default:
+		return 0, errors.New("unsupported time in force",
+			j.KV("time_in_force", tif))
+	}
+}
+
+func makeSTP(stp orders.STP) (matcher.STP, error) {
+	switch stp {
+	case orders.STPCancelNewest:
+		return matcher.STPCancelNewest, nil
+	case orders.STPCancelOldest:
+		return matcher.STPCancelOldest, nil
+	case orders.STPCancelBoth:
+		return matcher.STPCancelBoth, nil
+	case orders.STPDecrement:
+		return matcher.STPDecrement, nil
+	default:
+		return 0, errors.New("unsupported self-trade prevention",
+			j.KV("stp", stp))
+	}
+}
+
+// buildOrderBook returns the market's order book at the sequence by loading
+// the latest snapshot and replaying subsequent order events of the market up
+// to and including the sequence through the matcher. It returns an error
+// if a replayed result's hash differs from the stored result's hash, since
+// the matcher would fork the results hash chain, eg. if the market config
+// changed.
+func buildOrderBook(ctx context.Context, dbc *sql.DB, market string, seq int64,
+	cfg markets.Config) (matcher.OrderBook, error) {
+
+	book, err := snapshots.LookupLatest(ctx, dbc, market, seq)
+	if errors.Is(err, sql.ErrNoRows) {
+		// No snapshot, replay from the start.
+		book = matcher.OrderBook{}
+	} else if err != nil {
+		return matcher.OrderBook{}, err
+	}
+
+	if book.Sequence == seq {
+		return book, nil
+	}
+
+	rl, err := results.ListInMarketAfter(ctx, dbc, market, book.Sequence)
+	if err != nil {
+		return matcher.OrderBook{}, err
+	}
+
+	// Results are deterministic, so duplicates have the same hash.
+	hashes := make(map[int64]string)
+	for _, res := range rl {
+		for _, r := range res.Results {
+			hashes[r.Sequence] = r.Hash
+		}
+	}
+
+	err = streamCommands(ctx, dbc, market, book.Sequence, seq,
+		func(cmd matcher.Command) error {
+			r, err := matcher.MatchCommand(&book, cmd, cfg)
+			if err != nil && cfg.ErrorPolicy != markets.ErrorPolicyReject {
+				return err
+			}
+			book.Sequence = cmd.Sequence
+
+			if hash := hashes[cmd.Sequence]; hash != "" && hash != r.Hash {
+				return errors.New("result hash mismatch",
+					j.MKV{"seq": cmd.Sequence, "stored": hash, "replayed": r.Hash})
+			}
+
+			return nil
+		})
+	if err != nil {
+		return book, err
+	}
+
+	book.Sequence = seq
+
+	return book, nil
+}
+
+// streamCommands calls the function with the market's commands of the
+// order events after the sequence up to and including the sequence to.
+func streamCommands(ctx context.Context, dbc *sql.DB, market string,
+	after, to int64, fn func(matcher.Command) error) error {
+
+	// Cancel the stream when done.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sc, err := orders.ToStream(dbc)(ctx, strconv.FormatInt(after, 10))
+	if err != nil {
+		return err
+	}
+
+	for last := after; last < to; {
+		e, err := sc.Recv()
+		if err != nil {
+			return err
+		}
+
+		if e.IDInt() > to {
+			return errors.New("order events sequence mismatch",
+				j.MKV{"want": to, "got": last})
+		}
+
+		// Invalid commands are replayed like the live matcher.
+		cmd, ok, _ := makeCommand(e)
+		if ok && cmd.Market == market {
+			if err := fn(cmd); err != nil {
+				return err
+			}
+		}
+
+		last = e.IDInt()
+	}
+
+	return nil
 }
 
 func goChan(f func() error) <-chan error {
@@ -295,85 +877,239 @@ func goChan(f func() error) <-chan error {
 	return ch
 }
 
-func ConsumeResults(ctx context.Context, dbc *sql.DB) error {
+// SweepExpired periodically requests expiry of posted orders that have
+// expired. The matcher removes them from the order book when it receives
+// the resulting order events, keeping matching deterministic.
+func SweepExpired(ctx context.Context, dbc *sql.DB, period time.Duration) error {
+	const limit = 100
+	for {
+		ol, err := orders.ListExpired(ctx, dbc, time.Now(), limit)
+		if err != nil {
+			return err
+		}
+
+		for _, o := range ol {
+			err := orders.RequestExpire(ctx, dbc, o.ID)
+			if errors.Is(err, shift.ErrRowCount) {
+				// Order status changed concurrently.
+				continue
+			} else if err != nil {
+				return err
+			}
+		}
+
+		if len(ol) == limit {
+			// There may be more.
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(period):
+		}
+	}
+}
+
+// ConsumeResults stores the trades and updates the orders of the stored
+// results. Only the WithRegistry and WithTracer options apply.
+//
+// It is idempotent, so results reprocessed after a crash or restart
+// skip trades already created and order updates already applied.
+func ConsumeResults(ctx context.Context, dbc *sql.DB, opts ...Option) error {
+	return consumeResults(ctx, dbc, dbWriter{dbc: dbc}, opts...)
+}
+
+func consumeResults(ctx context.Context, dbc *sql.DB, w resultWriter, opts ...Option) error {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var err error
+	o.prom, err = o.collector()
+	if err != nil {
+		return err
+	}
+
 	spec := reflex.NewSpec(
 		results.ToStream(dbc),
 		cursors.ToStore(dbc),
-		makeResultConsumec(dbc),
+		makeResultConsumec(dbc, w, o),
 	)
 	return reflex.Run(ctx, spec)
 }
 
-func makeResultConsumec(dbc *sql.DB) reflex.Consumer {
+// resultWriter writes the trades and order updates of consumed results.
+type resultWriter interface {
+	CreateTrade(ctx context.Context, req trades.CreateReq) error
+	UpdatePosted(ctx context.Context, id, seq int64) error
+	UpdateSlid(ctx context.Context, id, seq int64, price decimal.Decimal) error
+	UpdateAmended(ctx context.Context, id, seq int64) error
+	Complete(ctx context.Context, id, seq int64) error
+}
+
+// dbWriter writes to the trades and orders tables.
+type dbWriter struct {
+	dbc *sql.DB
+}
+
+func (w dbWriter) CreateTrade(ctx context.Context, req trades.CreateReq) error {
+	_, err := trades.Create(ctx, w.dbc, req)
+	return err
+}
+
+func (w dbWriter) UpdatePosted(ctx context.Context, id, seq int64) error {
+	return orders.UpdatePosted(ctx, w.dbc, id, seq)
+}
+
+func (w dbWriter) UpdateSlid(ctx context.Context, id, seq int64, price decimal.Decimal) error {
+	return orders.UpdateSlid(ctx, w.dbc, id, seq, price)
+}
+
+func (w dbWriter) UpdateAmended(ctx context.Context, id, seq int64) error {
+	return orders.UpdateAmended(ctx, w.dbc, id, seq)
+}
+
+func (w dbWriter) Complete(ctx context.Context, id, seq int64) error {
+	return orders.Complete(ctx, w.dbc, id, seq)
+}
+
+func makeResultConsumec(dbc *sql.DB, w resultWriter, o options) reflex.Consumer {
 	// These results always complete orders.
 	complete := map[matcher.Type]bool{
-		matcher.TypeLimitTaker:    true,
-		matcher.TypeMarketEmpty:   true,
-		matcher.TypeMarketPartial: true,
-		matcher.TypeMarketFull:    true,
-		matcher.TypeCancelled:     true,
+		matcher.TypeLimitTaker:         true,
+		matcher.TypeMarketEmpty:        true,
+		matcher.TypeMarketPartial:      true,
+		matcher.TypeMarketFull:         true,
+		matcher.TypeCancelled:          true,
+		matcher.TypeIOCCancelled:       true,
+		matcher.TypeFOKKilled:          true,
+		matcher.TypeExpired:            true,
+		matcher.TypeSelfTradeCancelled: true,
+		matcher.TypeRejected:           true,
+		matcher.TypeFailed:             true,
 	}
 
 	posted := map[matcher.Type]bool{
 		matcher.TypePosted:       true,
 		matcher.TypeLimitMaker:   true,
 		matcher.TypeLimitPartial: true,
+		matcher.TypeStopAccepted: true,
+		matcher.TypeAmendFailed:  true,
 	}
 
-	return reflex.NewConsumer("result_consumer",
+	const name = "result_consumer"
+	return reflex.NewConsumer(name,
 		func(ctx context.Context, f fate.Fate, e *reflex.Event) error {
+			o.prom.observeLag(name, e)
 
 			result, err := results.Lookup(ctx, dbc, e.ForeignIDInt())
 			if err != nil {
 				return err
 			}
 
-			for _, r := range result.Results {
+			// seqIdx returns the next trade index of the sequence since
+			// triggered stop results share the sequence.
+			idx := make(map[int64]int)
+			seqIdx := func(seq int64) int {
+				i := idx[seq]
+				idx[seq]++
+				return i
+			}
+
+			for _, r := range flatten(result.Results) {
 
-				var completed []int64
+				// Orders cancelled by self-trade prevention or mass cancel
+				// are complete.
+				completed := append([]int64(nil), r.Cancelled...)
 
-				for i, t := range r.Trades {
-					_, err := trades.Create(ctx, dbc, trades.CreateReq{
+				for _, t := range r.Trades {
+					err := w.CreateTrade(ctx, trades.CreateReq{
+						Market:       result.Market,
 						IsBuy:        t.IsBuy,
 						Seq:          r.Sequence,
-						SeqIdx:       i,
+						SeqIdx:       seqIdx(r.Sequence),
 						Price:        t.Price,
 						Volume:       t.Volume,
 						MakerOrderID: t.MakerOrderID,
 						TakerOrderID: t.TakerOrderID,
+						MakerFee:     t.MakerFee,
+						TakerFee:     t.TakerFee,
 					})
-					// TODO(corver): Ignore duplicate on uniq index
-					if err != nil {
+					if errors.Is(err, trades.ErrDuplicate) {
+						// Trade already created, result is being reprocessed.
+					} else if err != nil {
 						return err
 					}
 
 					if t.MakerFilled {
 						completed = append(completed, t.MakerOrderID)
 					}
+					if t.TakerFilled {
+						completed = append(completed, t.TakerOrderID)
+					}
 				}
 
 				if posted[r.Type] {
-					err := orders.UpdatePosted(ctx, dbc, r.OrderID, r.Sequence)
-					// TODO(corver): Ignore already posted errors
+					err := w.UpdatePosted(ctx, r.OrderID, r.Sequence)
 					if err != nil {
 						return err
 					}
 				}
 
-				if complete[r.Type] {
+				if r.Type == matcher.TypePostSlid {
+					err := w.UpdateSlid(ctx, r.OrderID, r.Sequence, r.Price)
+					if err != nil {
+						return err
+					}
+				}
+
+				if r.Type == matcher.TypeAmended {
+					err := w.UpdateAmended(ctx, r.OrderID, r.Sequence)
+					if err != nil {
+						return err
+					}
+				}
+
+				if complete[r.Type] && r.OrderID != 0 {
+					// Failed control commands have no order.
 					completed = append(completed, r.OrderID)
 				}
 
 				for _, id := range completed {
-					err := orders.Complete(ctx, dbc, id, r.Sequence)
-					// TODO(corver): Ignore already complete errors
+					err := w.Complete(ctx, id, r.Sequence)
 					if err != nil {
 						return err
 					}
 				}
 			}
 
+			now := time.Now()
+			for _, r := range result.Results {
+				if r.Type == matcher.TypeCommandUnknown {
+					// Noops aren't order commands.
+					continue
+				}
+
+				o.prom.observeStage(stageConsume, now.Sub(result.CreatedAt))
+				if d, ok := o.tracer.updated(r.Sequence, now); ok {
+					o.prom.observeStage(stageTotal, d)
+				}
+			}
+
 			return nil
 		},
 	)
 }
+
+// flatten returns the results with any triggered results
+// following their parent result.
+func flatten(rl []matcher.Result) []matcher.Result {
+	var res []matcher.Result
+	for _, r := range rl {
+		res = append(res, r)
+		res = append(res, r.Triggered...)
+	}
+	return res
+}
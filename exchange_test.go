@@ -1,12 +1,16 @@
 package exchange
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"github.com/corverroos/exchange/db"
+	"github.com/corverroos/exchange/db/cursors"
 	"github.com/corverroos/exchange/db/orders"
 	"github.com/corverroos/exchange/db/results"
+	"github.com/corverroos/exchange/db/trades"
 	"github.com/corverroos/exchange/gen"
+	"github.com/corverroos/exchange/markets"
 	"github.com/corverroos/exchange/matcher"
 	"flag"
 	"fmt"
@@ -147,6 +151,924 @@ func TestRun(t *testing.T) {
 	require.Equal(t, 30, count)
 }
 
+func TestRestart(t *testing.T) {
+	defer unsure.CheatFateForTesting(t)()
+	dbc := setupDB(t)
+	ctx := context.Background()
+
+	// Create some post only orders and cancel one
+	posts := 5
+	for i := 0; i < posts; i++ {
+		_, err := orders.CreateLimit(ctx, dbc, true, d(99-i), d(1), true)
+		jtest.Require(t, nil, err)
+
+		_, err = orders.CreateLimit(ctx, dbc, false, d(100+i), d(1), true)
+		jtest.Require(t, nil, err)
+	}
+	err := orders.RequestCancel(ctx, dbc, 2)
+	jtest.Require(t, nil, err)
+
+	runUntil(t, dbc, 2*posts+1)
+
+	// Create market orders that require the rebuilt order book
+	_, err = orders.CreateMarketBuy(ctx, dbc, d(101))
+	jtest.Require(t, nil, err)
+
+	_, err = orders.CreateMarketSell(ctx, dbc, d(2))
+	jtest.Require(t, nil, err)
+
+	runUntil(t, dbc, 2*posts+3)
+
+	rl, err := results.ListAll(ctx, dbc)
+	require.NoError(t, err)
+
+	var types []matcher.Type
+	for _, result := range rl {
+		for _, r := range result.Results {
+			types = append(types, r.Type)
+		}
+	}
+	require.Len(t, types, 2*posts+3)
+	require.Equal(t, matcher.TypeCancelled, types[2*posts])
+	require.Equal(t, matcher.TypeMarketFull, types[2*posts+1])
+	require.Equal(t, matcher.TypeMarketFull, types[2*posts+2])
+}
+
+func TestRestartHashMismatch(t *testing.T) {
+	defer unsure.CheatFateForTesting(t)()
+	dbc := setupDB(t)
+	ctx := context.Background()
+
+	_, err := orders.CreateLimit(ctx, dbc, false, d(100), d(1), false)
+	jtest.Require(t, nil, err)
+
+	_, err = orders.CreateMarketBuy(ctx, dbc, d(50))
+	jtest.Require(t, nil, err)
+
+	runUntil(t, dbc, 2)
+
+	_, err = buildOrderBook(ctx, dbc, orders.DefaultMarket, 2, markets.Default)
+	jtest.Require(t, nil, err)
+
+	// Changed fees fork the results hash chain.
+	cfg := markets.Default
+	cfg.TakerFeeBps = d(10)
+	_, err = buildOrderBook(ctx, dbc, orders.DefaultMarket, 2, cfg)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "result hash mismatch")
+}
+
+func TestSnapshots(t *testing.T) {
+	defer unsure.CheatFateForTesting(t)()
+	dbc := setupDB(t)
+	ctx := context.Background()
+
+	posts := 5
+	for i := 0; i < posts; i++ {
+		_, err := orders.CreateLimit(ctx, dbc, true, d(99-i), d(1), true)
+		jtest.Require(t, nil, err)
+
+		_, err = orders.CreateLimit(ctx, dbc, false, d(100+i), d(1), true)
+		jtest.Require(t, nil, err)
+	}
+
+	runUntil(t, dbc, 2*posts, WithSnapshots(2, 0, 2))
+
+	// Only the last 2 snapshots are kept.
+	var count int
+	waitFor(t, time.Second, func() bool {
+		err := dbc.QueryRow("select count(*) from snapshots").Scan(&count)
+		require.NoError(t, err)
+		return count == 2
+	})
+
+	// Corrupt the latest snapshot, the previous one should be used.
+	_, err := dbc.Exec("update snapshots set checksum='corrupt' order by id desc limit 1")
+	require.NoError(t, err)
+
+	_, err = orders.CreateMarketSell(ctx, dbc, d(posts))
+	jtest.Require(t, nil, err)
+
+	runUntil(t, dbc, 2*posts+1, WithSnapshots(2, 0, 2))
+
+	r, err := results.LookupLast(ctx, dbc)
+	jtest.Require(t, nil, err)
+	require.Equal(t, matcher.TypeMarketFull, r.Results[len(r.Results)-1].Type)
+}
+
+func TestExpiry(t *testing.T) {
+	defer unsure.CheatFateForTesting(t)()
+	dbc := setupDB(t)
+	ctx := context.Background()
+
+	expired, err := orders.CreateLimit(ctx, dbc, true, d(99), d(1), false,
+		orders.WithExpiry(time.Now()))
+	jtest.Require(t, nil, err)
+
+	active, err := orders.CreateLimit(ctx, dbc, true, d(98), d(1), false,
+		orders.WithExpiry(time.Now().Add(time.Hour)))
+	jtest.Require(t, nil, err)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		jtest.Assert(t, context.Canceled, Run(ctx, dbc))
+	}()
+	go func() {
+		jtest.Assert(t, context.Canceled, ConsumeResults(ctx, dbc))
+	}()
+	go func() {
+		jtest.Assert(t, context.Canceled, SweepExpired(ctx, dbc, time.Millisecond*10))
+	}()
+
+	waitFor(t, time.Second, func() bool {
+		o, err := orders.Lookup(ctx, dbc, expired)
+		jtest.Require(t, nil, err)
+		return o.Status == orders.StatusComplete
+	})
+
+	r, err := results.LookupLast(ctx, dbc)
+	jtest.Require(t, nil, err)
+	require.Equal(t, matcher.TypeExpired, r.Results[len(r.Results)-1].Type)
+
+	o, err := orders.Lookup(ctx, dbc, active)
+	jtest.Require(t, nil, err)
+	require.Equal(t, orders.StatusPosted, o.Status)
+}
+
+func TestAmend(t *testing.T) {
+	defer unsure.CheatFateForTesting(t)()
+	dbc := setupDB(t)
+	ctx := context.Background()
+
+	id, err := orders.CreateLimit(ctx, dbc, true, d(99), d(2), false)
+	jtest.Require(t, nil, err)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		jtest.Assert(t, context.Canceled, Run(ctx, dbc))
+	}()
+	go func() {
+		jtest.Assert(t, context.Canceled, ConsumeResults(ctx, dbc))
+	}()
+
+	waitStatus := func(status orders.Status) *orders.Order {
+		var o *orders.Order
+		waitFor(t, time.Second, func() bool {
+			var err error
+			o, err = orders.Lookup(ctx, dbc, id)
+			jtest.Require(t, nil, err)
+			return o.Status == status
+		})
+		return o
+	}
+
+	waitStatus(orders.StatusPosted)
+
+	err = orders.RequestAmend(ctx, dbc, id, d(98), d(1))
+	jtest.Require(t, nil, err)
+
+	o := waitStatus(orders.StatusPosted)
+	require.True(t, o.LimitPrice.Equal(d(98)))
+	require.True(t, o.LimitVolume.Equal(d(1)))
+
+	r, err := results.LookupLast(ctx, dbc)
+	jtest.Require(t, nil, err)
+	require.Equal(t, matcher.TypeAmended, r.Results[len(r.Results)-1].Type)
+
+	_, err = orders.CreateLimit(ctx, dbc, false, d(100), d(1), false)
+	jtest.Require(t, nil, err)
+
+	// Amend to a price that crosses the ask.
+	err = orders.RequestAmend(ctx, dbc, id, d(101), d(1))
+	jtest.Require(t, nil, err)
+
+	o = waitStatus(orders.StatusPosted)
+	require.True(t, o.LimitPrice.Equal(d(98)))
+
+	r, err = results.LookupLast(ctx, dbc)
+	jtest.Require(t, nil, err)
+	require.Equal(t, matcher.TypeAmendFailed, r.Results[len(r.Results)-1].Type)
+}
+
+func TestStopLimit(t *testing.T) {
+	defer unsure.CheatFateForTesting(t)()
+	dbc := setupDB(t)
+	ctx := context.Background()
+
+	_, err := orders.CreateLimit(ctx, dbc, false, d(100), d(1), false)
+	jtest.Require(t, nil, err)
+
+	// Posted when accepted and posted again when triggered by the next trade.
+	stop, err := orders.CreateStopLimit(ctx, dbc, true, d(100), d(99), d(1))
+	jtest.Require(t, nil, err)
+
+	_, err = orders.CreateLimit(ctx, dbc, true, d(100), d(1), false)
+	jtest.Require(t, nil, err)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		jtest.Assert(t, context.Canceled, Run(ctx, dbc))
+	}()
+	go func() {
+		jtest.Assert(t, context.Canceled, ConsumeResults(ctx, dbc))
+	}()
+
+	var r *results.Result
+	waitFor(t, time.Second, func() bool {
+		var err error
+		r, err = results.LookupLast(ctx, dbc)
+		return err == nil && r.EndSeq >= 3
+	})
+	last := r.Results[len(r.Results)-1]
+	require.Len(t, last.Triggered, 2)
+	require.Equal(t, matcher.TypeLimitMaker, last.Triggered[1].Type)
+
+	// The consumer doesn't stall on the triggered result.
+	sell, err := orders.CreateLimit(ctx, dbc, false, d(99), d(1), false)
+	jtest.Require(t, nil, err)
+
+	for _, id := range []int64{stop, sell} {
+		waitFor(t, time.Second, func() bool {
+			o, err := orders.Lookup(ctx, dbc, id)
+			jtest.Require(t, nil, err)
+			return o.Status == orders.StatusComplete
+		})
+	}
+}
+
+func TestPostOnlySlide(t *testing.T) {
+	defer unsure.CheatFateForTesting(t)()
+	dbc := setupDB(t)
+	ctx := context.Background()
+
+	_, err := orders.CreateLimit(ctx, dbc, false, d(100), d(1), false)
+	jtest.Require(t, nil, err)
+
+	id, err := orders.CreateLimit(ctx, dbc, true, d(101), d(1), true, orders.WithSlide())
+	jtest.Require(t, nil, err)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		jtest.Assert(t, context.Canceled, Run(ctx, dbc))
+	}()
+	go func() {
+		jtest.Assert(t, context.Canceled, ConsumeResults(ctx, dbc))
+	}()
+
+	var o *orders.Order
+	waitFor(t, time.Second, func() bool {
+		var err error
+		o, err = orders.Lookup(ctx, dbc, id)
+		jtest.Require(t, nil, err)
+		return o.Status == orders.StatusPosted
+	})
+
+	// Slid to one default tick (1e-8) below the best ask.
+	require.True(t, o.LimitPrice.Equal(d(100).Sub(decimal.New(1, -8))))
+
+	r, err := results.LookupLast(ctx, dbc)
+	jtest.Require(t, nil, err)
+	require.Equal(t, matcher.TypePostSlid, r.Results[len(r.Results)-1].Type)
+}
+
+func TestAuction(t *testing.T) {
+	defer unsure.CheatFateForTesting(t)()
+	dbc := setupDB(t)
+	ctx := context.Background()
+
+	err := orders.StartAuction(ctx, dbc, orders.DefaultMarket)
+	jtest.Require(t, nil, err)
+
+	bid, err := orders.CreateLimit(ctx, dbc, true, d(101), d(2), false)
+	jtest.Require(t, nil, err)
+
+	ask, err := orders.CreateLimit(ctx, dbc, false, d(99), d(1), false)
+	jtest.Require(t, nil, err)
+
+	err = orders.Uncross(ctx, dbc, orders.DefaultMarket)
+	jtest.Require(t, nil, err)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		jtest.Assert(t, context.Canceled, Run(ctx, dbc))
+	}()
+	go func() {
+		jtest.Assert(t, context.Canceled, ConsumeResults(ctx, dbc))
+	}()
+
+	waitFor(t, time.Second, func() bool {
+		o, err := orders.Lookup(ctx, dbc, ask)
+		jtest.Require(t, nil, err)
+		return o.Status == orders.StatusComplete
+	})
+
+	o, err := orders.Lookup(ctx, dbc, bid)
+	jtest.Require(t, nil, err)
+	require.Equal(t, orders.StatusPosted, o.Status)
+
+	r, err := results.LookupLast(ctx, dbc)
+	jtest.Require(t, nil, err)
+	uncross := r.Results[len(r.Results)-1]
+	require.Equal(t, matcher.TypeUncrossed, uncross.Type)
+	// Both prices execute 1 with surplus 1, so the lowest applies.
+	require.True(t, uncross.Price.Equal(d(99)))
+	require.Len(t, uncross.Trades, 1)
+}
+
+func TestHalt(t *testing.T) {
+	defer unsure.CheatFateForTesting(t)()
+	dbc := setupDB(t)
+	ctx := context.Background()
+
+	ask, err := orders.CreateLimit(ctx, dbc, false, d(100), d(1), false)
+	jtest.Require(t, nil, err)
+
+	err = orders.Halt(ctx, dbc, orders.DefaultMarket)
+	jtest.Require(t, nil, err)
+
+	bid, err := orders.CreateLimit(ctx, dbc, true, d(100), d(1), false)
+	jtest.Require(t, nil, err)
+
+	err = orders.RequestCancel(ctx, dbc, ask)
+	jtest.Require(t, nil, err)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		jtest.Assert(t, context.Canceled, Run(ctx, dbc))
+	}()
+	go func() {
+		jtest.Assert(t, context.Canceled, ConsumeResults(ctx, dbc))
+	}()
+
+	for _, id := range []int64{ask, bid} {
+		waitFor(t, time.Second, func() bool {
+			o, err := orders.Lookup(ctx, dbc, id)
+			jtest.Require(t, nil, err)
+			return o.Status == orders.StatusComplete
+		})
+	}
+
+	r, err := results.LookupLast(ctx, dbc)
+	jtest.Require(t, nil, err)
+	// The ask was cancelled, not traded, since the bid was rejected.
+	require.Equal(t, matcher.TypeCancelled, r.Results[len(r.Results)-1].Type)
+}
+
+func TestSelfTrade(t *testing.T) {
+	defer unsure.CheatFateForTesting(t)()
+	dbc := setupDB(t)
+	ctx := context.Background()
+
+	maker, err := orders.CreateLimit(ctx, dbc, false, d(100), d(1), false,
+		orders.WithAccount(1))
+	jtest.Require(t, nil, err)
+
+	taker, err := orders.CreateLimit(ctx, dbc, true, d(100), d(1), false,
+		orders.WithAccount(1), orders.WithSTP(orders.STPCancelOldest))
+	jtest.Require(t, nil, err)
+
+	runUntil(t, dbc, int(taker))
+
+	r, err := results.LookupLast(ctx, dbc)
+	jtest.Require(t, nil, err)
+	last := r.Results[len(r.Results)-1]
+	require.Equal(t, matcher.TypeLimitMaker, last.Type)
+	require.Equal(t, []int64{maker}, last.Cancelled)
+	require.Empty(t, last.Trades)
+}
+
+func TestMarkets(t *testing.T) {
+	defer unsure.CheatFateForTesting(t)()
+	dbc := setupDB(t)
+	ctx := context.Background()
+
+	const eth = "ETHBTC"
+	cfg := markets.Default
+	cfg.Market = eth
+	registerMarket(t, cfg)
+
+	_, err := orders.CreateLimit(ctx, dbc, false, d(100), d(1), false)
+	jtest.Require(t, nil, err)
+
+	_, err = orders.CreateLimit(ctx, dbc, false, d(100), d(1), false,
+		orders.WithMarket(eth))
+	jtest.Require(t, nil, err)
+
+	// Only trades with the ask in its own market.
+	_, err = orders.CreateLimit(ctx, dbc, true, d(100), d(2), false,
+		orders.WithMarket(eth))
+	jtest.Require(t, nil, err)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		jtest.Assert(t, context.Canceled, Run(ctx, dbc,
+			WithMarkets(orders.DefaultMarket, eth)))
+	}()
+
+	waitFor(t, time.Second, func() bool {
+		r, err := results.LookupLastInMarket(ctx, dbc, eth)
+		if errors.Is(err, sql.ErrNoRows) {
+			return false
+		}
+		jtest.Require(t, nil, err)
+		return r.EndSeq == 3
+	})
+
+	r, err := results.LookupLastInMarket(ctx, dbc, eth)
+	jtest.Require(t, nil, err)
+	last := r.Results[len(r.Results)-1]
+	require.Equal(t, matcher.TypeLimitPartial, last.Type)
+	require.Len(t, last.Trades, 1)
+	require.Equal(t, int64(2), last.Trades[0].MakerOrderID)
+
+	r, err = results.LookupLastInMarket(ctx, dbc, orders.DefaultMarket)
+	jtest.Require(t, nil, err)
+	require.Equal(t, int64(1), r.EndSeq)
+	require.Equal(t, int64(1), r.MarketSeq)
+
+	// Each market has its own results sequence.
+	rl, err := results.ListInMarket(ctx, dbc, eth)
+	jtest.Require(t, nil, err)
+	for i, r := range rl {
+		require.Equal(t, int64(i+1), r.MarketSeq)
+	}
+}
+
+func TestRunInvalidMarkets(t *testing.T) {
+	registerMarket(t, markets.Config{Market: "LIFO", Allocation: "lifo"})
+
+	tests := []struct {
+		Name string
+		Opt  Option
+		Err  error
+	}{
+		{
+			Name: "unknown",
+			Opt:  WithMarkets("UNKNOWN"),
+			Err:  markets.ErrUnknownMarket,
+		},
+		{
+			Name: "invalid",
+			Opt:  WithMarkets("LIFO"),
+			Err:  markets.ErrUnknownAllocation,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			err := Run(context.Background(), nil, test.Opt)
+			jtest.Require(t, test.Err, err)
+		})
+	}
+
+	err := Run(context.Background(), nil, WithMarketsFile("missing.yaml"))
+	require.Error(t, err)
+}
+
+func TestMarketAmounts(t *testing.T) {
+	defer unsure.CheatFateForTesting(t)()
+	dbc := setupDB(t)
+	ctx := context.Background()
+
+	_, err := orders.CreateLimit(ctx, dbc, false, d(3), d(2), false)
+	jtest.Require(t, nil, err)
+
+	buy, err := orders.CreateMarketBuyCounter(ctx, dbc, d(1))
+	jtest.Require(t, nil, err)
+
+	_, err = orders.CreateLimit(ctx, dbc, true, d(2), d(5), false)
+	jtest.Require(t, nil, err)
+
+	sell, err := orders.CreateMarketSellBase(ctx, dbc, d(4))
+	jtest.Require(t, nil, err)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	tracer := NewTracer(10)
+	go func() {
+		jtest.Assert(t, context.Canceled, Run(ctx, dbc, WithTracer(tracer)))
+	}()
+	go func() {
+		jtest.Assert(t, context.Canceled, ConsumeResults(ctx, dbc, WithTracer(tracer)))
+	}()
+
+	for _, id := range []int64{buy, sell} {
+		waitFor(t, time.Second, func() bool {
+			o, err := orders.Lookup(ctx, dbc, id)
+			jtest.Require(t, nil, err)
+			return o.Status == orders.StatusComplete
+		})
+	}
+
+	r, err := results.LookupLast(ctx, dbc)
+	jtest.Require(t, nil, err)
+	last := r.Results[len(r.Results)-1]
+	require.Equal(t, matcher.TypeMarketFull, last.Type)
+	require.Len(t, last.Trades, 1)
+	require.True(t, last.Trades[0].Volume.Equal(d(2)))
+
+	waitFor(t, time.Second, func() bool {
+		tl := tracer.Traces(sell)
+		return len(tl) == 1 && !tl[0].Updated.IsZero()
+	})
+	require.Len(t, tracer.SlowOrders(10), 4)
+
+	tl, err := ListSlowOrders(ctx, dbc, time.Time{}, 10)
+	jtest.Require(t, nil, err)
+	require.Len(t, tl, 4)
+	for _, tr := range tl {
+		require.False(t, tr.Updated.Before(tr.Inserted))
+	}
+	require.True(t, tl[0].Latency() >= tl[3].Latency())
+}
+
+func TestFees(t *testing.T) {
+	defer unsure.CheatFateForTesting(t)()
+	dbc := setupDB(t)
+	ctx := context.Background()
+
+	const market = "FEEUSD"
+	cfg := markets.Default
+	cfg.Market = market
+	cfg.BaseScale = 2
+	cfg.MakerFeeBps = d(-1)
+	cfg.TakerFeeBps = d(5)
+	registerMarket(t, cfg)
+
+	_, err := orders.CreateLimit(ctx, dbc, false, d(100), d(1), false,
+		orders.WithMarket(market))
+	jtest.Require(t, nil, err)
+
+	_, err = orders.CreateLimit(ctx, dbc, true, d(100), d(1), false,
+		orders.WithMarket(market))
+	jtest.Require(t, nil, err)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		jtest.Assert(t, context.Canceled, Run(ctx, dbc, WithMarkets(market)))
+	}()
+	go func() {
+		jtest.Assert(t, context.Canceled, ConsumeResults(ctx, dbc))
+	}()
+
+	var tr *trades.Trade
+	waitFor(t, time.Second, func() bool {
+		tr, err = trades.Lookup(ctx, dbc, 1)
+		return err == nil
+	})
+
+	require.Equal(t, "-0.01", tr.MakerFee.String())
+	require.Equal(t, "0.05", tr.TakerFee.String())
+}
+
+func TestMassCancel(t *testing.T) {
+	defer unsure.CheatFateForTesting(t)()
+	dbc := setupDB(t)
+	ctx := context.Background()
+
+	var ids []int64
+	for _, acc := range []int64{1, 2, 1} {
+		id, err := orders.CreateLimit(ctx, dbc, false, d(100), d(1), false,
+			orders.WithAccount(acc))
+		jtest.Require(t, nil, err)
+		ids = append(ids, id)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		jtest.Assert(t, context.Canceled, Run(ctx, dbc))
+	}()
+	go func() {
+		jtest.Assert(t, context.Canceled, ConsumeResults(ctx, dbc))
+	}()
+
+	for _, id := range ids {
+		waitFor(t, time.Second, func() bool {
+			o, err := orders.Lookup(ctx, dbc, id)
+			jtest.Require(t, nil, err)
+			return o.Status == orders.StatusPosted
+		})
+	}
+
+	err := orders.MassCancel(ctx, dbc, orders.DefaultMarket,
+		orders.CancelFilter{AccountID: 1, Side: orders.CancelAsks})
+	jtest.Require(t, nil, err)
+
+	for _, id := range []int64{ids[0], ids[2]} {
+		waitFor(t, time.Second, func() bool {
+			o, err := orders.Lookup(ctx, dbc, id)
+			jtest.Require(t, nil, err)
+			return o.Status == orders.StatusComplete
+		})
+	}
+
+	o, err := orders.Lookup(ctx, dbc, ids[1])
+	jtest.Require(t, nil, err)
+	require.Equal(t, orders.StatusPosted, o.Status)
+
+	r, err := results.LookupLast(ctx, dbc)
+	jtest.Require(t, nil, err)
+	last := r.Results[len(r.Results)-1]
+	require.Equal(t, matcher.TypeMassCancelled, last.Type)
+	require.Equal(t, []int64{ids[0], ids[2]}, last.Cancelled)
+}
+
+func TestReplay(t *testing.T) {
+	defer unsure.CheatFateForTesting(t)()
+	dbc := setupDB(t)
+	ctx := context.Background()
+
+	_, err := orders.CreateLimit(ctx, dbc, false, d(100), d(2), false)
+	jtest.Require(t, nil, err)
+
+	// Other markets' events are replayed as noops.
+	_, err = orders.CreateLimit(ctx, dbc, true, d(100), d(1), false,
+		orders.WithMarket("ETHBTC"))
+	jtest.Require(t, nil, err)
+
+	_, err = orders.CreateLimit(ctx, dbc, true, d(100), d(1), false)
+	jtest.Require(t, nil, err)
+
+	runUntil(t, dbc, 3)
+
+	stored, seq, err := LoadResults(ctx, dbc, orders.DefaultMarket)
+	jtest.Require(t, nil, err)
+	require.Equal(t, int64(3), seq)
+
+	cl, err := LoadCommands(ctx, dbc, orders.DefaultMarket, seq)
+	jtest.Require(t, nil, err)
+	require.Len(t, cl, 2)
+
+	// Round trip the commands via JSON lines.
+	var buf bytes.Buffer
+	jtest.Require(t, nil, WriteCommands(&buf, cl))
+	cl, err = ReadCommands(&buf)
+	jtest.Require(t, nil, err)
+
+	rl, err := Replay(ctx, cl, markets.Default)
+	jtest.Require(t, nil, err)
+
+	_, broken, err := FirstBrokenHash(cl, stored)
+	jtest.Require(t, nil, err)
+	require.False(t, broken)
+
+	last, err := results.LookupLast(ctx, dbc)
+	jtest.Require(t, nil, err)
+	require.Equal(t, stored[len(stored)-1].Hash, last.Hash)
+
+	_, diverged, err := FirstDivergence(stored, rl)
+	jtest.Require(t, nil, err)
+	require.False(t, diverged)
+
+	rl[1].Trades[0].Volume = d(2)
+	first, diverged, err := FirstDivergence(stored, rl)
+	jtest.Require(t, nil, err)
+	require.True(t, diverged)
+	require.Equal(t, int64(3), first)
+
+	first, broken, err = FirstBrokenHash(cl, rl)
+	jtest.Require(t, nil, err)
+	require.True(t, broken)
+	require.Equal(t, int64(3), first)
+}
+
+func TestConsumeResultsIdempotent(t *testing.T) {
+	defer unsure.CheatFateForTesting(t)()
+	ctx := context.Background()
+
+	// setup stores the results of posting two asks and one bid and
+	// a bid that trades with both asks.
+	setup := func() *sql.DB {
+		dbc := setupDB(t)
+
+		for _, o := range []struct {
+			isBuy         bool
+			price, volume int
+		}{
+			{false, 100, 1},
+			{false, 101, 2},
+			{true, 99, 1},
+			{true, 101, 2},
+		} {
+			_, err := orders.CreateLimit(ctx, dbc, o.isBuy, d(o.price), d(o.volume), false)
+			jtest.Require(t, nil, err)
+		}
+
+		runUntil(t, dbc, 4)
+		return dbc
+	}
+
+	// state returns the orders and trades excluding timestamps and
+	// trade IDs which differ between runs.
+	state := func(dbc *sql.DB) ([]orders.Order, []trades.Trade) {
+		var ol []orders.Order
+		err := orders.ScanAll(ctx, dbc, func(o *orders.Order) error {
+			o.CreatedAt = time.Time{}
+			o.UpdatedAt = time.Time{}
+			ol = append(ol, *o)
+			return nil
+		})
+		jtest.Require(t, nil, err)
+
+		tl, err := trades.ListAll(ctx, dbc)
+		jtest.Require(t, nil, err)
+		for i := range tl {
+			tl[i].ID = 0
+			tl[i].CreatedAt = time.Time{}
+		}
+
+		return ol, tl
+	}
+
+	// consume runs the consumer until the expected final order state.
+	consume := func(dbc *sql.DB, w resultWriter) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		errc := make(chan error, 1)
+		go func() {
+			errc <- consumeResults(ctx, dbc, w)
+		}()
+
+		expect := []orders.Status{orders.StatusComplete, orders.StatusPosted,
+			orders.StatusPosted, orders.StatusComplete}
+		waitFor(t, time.Second, func() bool {
+			ol, tl := state(dbc)
+			if len(ol) != len(expect) || len(tl) != 2 {
+				return false
+			}
+			for i, o := range ol {
+				if o.Status != expect[i] {
+					return false
+				}
+			}
+			return true
+		})
+
+		cancel()
+		jtest.Assert(t, context.Canceled, <-errc)
+	}
+
+	dbc := setup()
+	counter := &crashWriter{resultWriter: dbWriter{dbc: dbc}}
+	consume(dbc, counter)
+	expOrders, expTrades := state(dbc)
+	jtest.Require(t, nil, dbc.Close())
+
+	// Posted updates of 3 orders, 2 trades and 2 completed orders.
+	steps := atomic.LoadInt64(&counter.n)
+	require.Equal(t, int64(7), steps)
+
+	for i := int64(1); i <= steps; i++ {
+		dbc := setup()
+
+		// Crash before write i, leaving the previous writes applied.
+		err := consumeResults(ctx, dbc, &crashWriter{
+			resultWriter: dbWriter{dbc: dbc},
+			crashAt:      i,
+		})
+		jtest.Require(t, errCrash, err)
+
+		consume(dbc, dbWriter{dbc: dbc})
+
+		ol, tl := state(dbc)
+		require.Equal(t, expOrders, ol, "crash at step %d", i)
+		require.Equal(t, expTrades, tl, "crash at step %d", i)
+		jtest.Require(t, nil, dbc.Close())
+	}
+
+	// Crash after all writes but before the cursor is stored, so all
+	// results are redelivered.
+	dbc = setup()
+	consume(dbc, dbWriter{dbc: dbc})
+
+	cs := cursors.ToStore(dbc)
+	jtest.Require(t, nil, cs.SetCursor(ctx, "result_consumer", "0"))
+	jtest.Require(t, nil, cs.Flush(ctx))
+
+	redeliver := &crashWriter{resultWriter: dbWriter{dbc: dbc}}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- consumeResults(ctx, dbc, redeliver)
+	}()
+
+	waitFor(t, time.Second, func() bool {
+		return atomic.LoadInt64(&redeliver.n) == steps
+	})
+	cancel()
+	jtest.Assert(t, context.Canceled, <-errc)
+
+	// No duplicate trades and order statuses and update sequences unchanged.
+	ol, tl := state(dbc)
+	require.Equal(t, expOrders, ol)
+	require.Equal(t, expTrades, tl)
+	jtest.Require(t, nil, dbc.Close())
+}
+
+var errCrash = errors.New("crash")
+
+// crashWriter counts the result consumer writes and returns errCrash
+// instead of the write at step crashAt, if set.
+type crashWriter struct {
+	resultWriter
+	crashAt int64
+	n       int64
+}
+
+func (w *crashWriter) step() error {
+	if atomic.AddInt64(&w.n, 1) == w.crashAt {
+		return errCrash
+	}
+	return nil
+}
+
+func (w *crashWriter) CreateTrade(ctx context.Context, req trades.CreateReq) error {
+	if err := w.step(); err != nil {
+		return err
+	}
+	return w.resultWriter.CreateTrade(ctx, req)
+}
+
+func (w *crashWriter) UpdatePosted(ctx context.Context, id, seq int64) error {
+	if err := w.step(); err != nil {
+		return err
+	}
+	return w.resultWriter.UpdatePosted(ctx, id, seq)
+}
+
+func (w *crashWriter) UpdateSlid(ctx context.Context, id, seq int64, price decimal.Decimal) error {
+	if err := w.step(); err != nil {
+		return err
+	}
+	return w.resultWriter.UpdateSlid(ctx, id, seq, price)
+}
+
+func (w *crashWriter) UpdateAmended(ctx context.Context, id, seq int64) error {
+	if err := w.step(); err != nil {
+		return err
+	}
+	return w.resultWriter.UpdateAmended(ctx, id, seq)
+}
+
+func (w *crashWriter) Complete(ctx context.Context, id, seq int64) error {
+	if err := w.step(); err != nil {
+		return err
+	}
+	return w.resultWriter.Complete(ctx, id, seq)
+}
+
+// runUntil runs the exchange until the result with sequence seq is stored.
+func runUntil(t *testing.T, dbc *sql.DB, seq int, opts ...Option) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- Run(ctx, dbc, opts...)
+	}()
+
+	waitFor(t, time.Second, func() bool {
+		r, err := results.LookupLast(ctx, dbc)
+		if errors.Is(err, sql.ErrNoRows) {
+			return false
+		}
+		assert.NoError(t, err)
+		return r.EndSeq >= int64(seq)
+	})
+
+	cancel()
+	jtest.Assert(t, context.Canceled, <-errc)
+}
+
+// registerMarket registers the market config until the test completes.
+func registerMarket(t *testing.T, cfg markets.Config) {
+	markets.Register(cfg)
+	t.Cleanup(func() {
+		markets.Unregister(cfg.Market)
+	})
+}
+
 func setupDB(t *testing.T) *sql.DB {
 	err := flag.Lookup("db_recreate").Value.Set("true")
 	require.NoError(t, err)
@@ -345,8 +1267,9 @@ type depth struct {
 }
 
 func (d *depth) Set(book *matcher.OrderBook) {
-	atomic.StoreInt64(&d.bids, int64(len(book.Bids)))
-	atomic.StoreInt64(&d.asks, int64(len(book.Asks)))
+	bids, asks := book.Len()
+	atomic.StoreInt64(&d.bids, int64(bids))
+	atomic.StoreInt64(&d.asks, int64(asks))
 }
 func (d *depth) Get() (int64, int64) {
 	return atomic.LoadInt64(&d.bids), atomic.LoadInt64(&d.asks)
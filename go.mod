@@ -4,6 +4,7 @@ go 1.16
 
 require (
 	github.com/corverroos/unsure v0.0.0-20200127140516-30bfc314b5fc
+	github.com/go-sql-driver/mysql v1.4.1
 	github.com/luno/fate v0.0.0-20190906093333-f60ec39889bc
 	github.com/luno/jettison v0.0.0-20191223144501-7fe4a971f291
 	github.com/luno/reflex v0.0.0-20191217150610-7e0cb14bb33a
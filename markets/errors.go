@@ -0,0 +1,27 @@
+package markets
+
+import (
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/j"
+)
+
+var (
+	ErrUnknownMarket   = errors.New("unknown market", j.C("ERR_81a734b8c513f3fe"))
+	ErrInvalidPrice    = errors.New("price not positive", j.C("ERR_d544e8612aef0a26"))
+	ErrPriceTick       = errors.New("price not a multiple of tick", j.C("ERR_a5f6f6219ae0518a"))
+	ErrInvalidVolume   = errors.New("volume not positive", j.C("ERR_d162b04b8459034a"))
+	ErrVolumeStep      = errors.New("volume not a multiple of step", j.C("ERR_10e7e9296a772238"))
+	ErrVolumeScale     = errors.New("volume exceeds counter scale", j.C("ERR_c6119b79df902463"))
+	ErrMinVolume       = errors.New("volume below minimum", j.C("ERR_f9614a5418f52026"))
+	ErrMaxVolume       = errors.New("volume above maximum", j.C("ERR_fd49d89a605137eb"))
+	ErrMinNotional     = errors.New("notional value below minimum", j.C("ERR_a597de9e66448958"))
+	ErrAmountScale     = errors.New("amount exceeds base scale", j.C("ERR_5842ea17d0da0085"))
+	ErrInvalidAmount   = errors.New("amount not positive", j.C("ERR_0c5e5d6c7b2e41a9"))
+	ErrDuplicateMarket = errors.New("duplicate market config", j.C("ERR_3f9b1c04d8a2e675"))
+	ErrInvalidSlippage = errors.New("slippage not between 0 and 100 percent", j.C("ERR_6d21b8e5a0f4c397"))
+
+	ErrUnknownAllocation   = errors.New("unknown allocation policy", j.C("ERR_9e4a2c71f08d5b36"))
+	ErrDuplicateFeeAccount = errors.New("account in multiple fee tiers", j.C("ERR_47c0e2b91d6a8f53"))
+	ErrAmountAndVolume     = errors.New("both amount and volume provided", j.C("ERR_b2d85f0a6c1e9347"))
+	ErrUnknownErrorPolicy  = errors.New("unknown error policy", j.C("ERR_2713b9adba4ced0a"))
+)
@@ -0,0 +1,351 @@
+// Package markets defines the trading rules of markets (pairs) that are
+// enforced when creating orders and defensively by the matcher.
+package markets
+
+import (
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/j"
+	"github.com/shopspring/decimal"
+	"gopkg.in/yaml.v2"
+)
+
+// Config defines the trading rules of a market. Zero decimal values
+// disable the respective rule.
+//
+// Note that base refers to price*volume amounts and counter to volume.
+type Config struct {
+	Market string `yaml:"market"`
+
+	PriceTick   decimal.Decimal `yaml:"price_tick"`   // Prices must be a multiple of the tick.
+	VolumeStep  decimal.Decimal `yaml:"volume_step"`  // Volumes must be a multiple of the step.
+	MinVolume   decimal.Decimal `yaml:"min_volume"`   // Minimum order volume.
+	MaxVolume   decimal.Decimal `yaml:"max_volume"`   // Maximum order volume.
+	MinNotional decimal.Decimal `yaml:"min_notional"` // Minimum order price*volume.
+
+	BaseScale    int `yaml:"base_scale"`    // Decimal places of base amounts.
+	CounterScale int `yaml:"counter_scale"` // Decimal places of counter volumes.
+
+	// Allocation is the policy allocating taker volume to the maker
+	// orders of a price level. The default is AllocationFIFO.
+	Allocation Allocation `yaml:"allocation"`
+
+	// TopPriority fills the first order of a price level before pro-rata
+	// allocation of the rest.
+	TopPriority bool `yaml:"top_priority"`
+
+	// MinAllocation is the minimum pro-rata allocation. Smaller
+	// allocations are dropped and allocated FIFO with the rounding
+	// remainder.
+	MinAllocation decimal.Decimal `yaml:"min_allocation"`
+
+	// BreakerPct halts the market if a trade price moves more than the
+	// percentage from the reference price; the first trade price of the
+	// breaker window. Zero disables the circuit breaker.
+	BreakerPct decimal.Decimal `yaml:"breaker_pct"`
+
+	// BreakerWindow is the duration after which the reference price is
+	// reset. Zero retains the reference until halted.
+	BreakerWindow time.Duration `yaml:"breaker_window"`
+
+	// MakerFeeBps and TakerFeeBps are the default fee rates in basis
+	// points of the trade's base amount. Negative rates are rebates.
+	MakerFeeBps decimal.Decimal `yaml:"maker_fee_bps"`
+	TakerFeeBps decimal.Decimal `yaml:"taker_fee_bps"`
+
+	// FeeTiers override the default fee rates of their accounts.
+	FeeTiers []FeeTier `yaml:"fee_tiers"`
+
+	// ErrorPolicy defines how the matcher handles commands that fail
+	// unexpectedly. The default is ErrorPolicyStop.
+	ErrorPolicy ErrorPolicy `yaml:"error_policy"`
+}
+
+// FeeTier defines the fee rates of a set of accounts.
+type FeeTier struct {
+	Name        string          `yaml:"name"`
+	Accounts    []int64         `yaml:"accounts"`
+	MakerFeeBps decimal.Decimal `yaml:"maker_fee_bps"`
+	TakerFeeBps decimal.Decimal `yaml:"taker_fee_bps"`
+}
+
+// Allocation defines how taker volume is allocated to the maker
+// orders of a price level.
+type Allocation string
+
+const (
+	// AllocationFIFO allocates by price-time priority.
+	AllocationFIFO Allocation = "fifo"
+
+	// AllocationProRata allocates proportionally to order volume,
+	// rounded down to the counter scale. Rounding remainders are
+	// allocated by time priority.
+	AllocationProRata Allocation = "pro_rata"
+)
+
+// Valid returns true if the allocation is known. Empty is valid
+// and equivalent to AllocationFIFO.
+func (a Allocation) Valid() bool {
+	return a == "" || a == AllocationFIFO || a == AllocationProRata
+}
+
+// ErrorPolicy defines how the matcher handles commands that fail
+// unexpectedly. Both are deterministic on replay.
+type ErrorPolicy string
+
+const (
+	// ErrorPolicyStop stops the matcher with the error. The market
+	// doesn't progress until the cause is fixed.
+	ErrorPolicyStop ErrorPolicy = "stop"
+
+	// ErrorPolicyReject outputs a failed result for the command and
+	// continues matching.
+	ErrorPolicyReject ErrorPolicy = "reject"
+)
+
+// Valid returns true if the error policy is known. Empty is valid
+// and equivalent to ErrorPolicyStop.
+func (p ErrorPolicy) Valid() bool {
+	return p == "" || p == ErrorPolicyStop || p == ErrorPolicyReject
+}
+
+// Default is the config of the default market if not registered and
+// the defaults of loaded configs. It has no trading rules except scales.
+var Default = Config{
+	BaseScale:    8,
+	CounterScale: 8,
+}
+
+// UnmarshalYAML sets the config from YAML applying defaults to
+// missing fields.
+func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Config
+	p := plain(Default)
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+
+	*c = Config(p)
+	return nil
+}
+
+// ValidatePrice returns an error if the price doesn't conform.
+func (c Config) ValidatePrice(price decimal.Decimal) error {
+	if price.Sign() <= 0 {
+		return ErrInvalidPrice
+	}
+
+	if c.PriceTick.Sign() > 0 && !price.Mod(c.PriceTick).IsZero() {
+		return ErrPriceTick
+	}
+
+	return nil
+}
+
+// ValidateVolume returns an error if the volume doesn't conform.
+func (c Config) ValidateVolume(volume decimal.Decimal) error {
+	if volume.Sign() <= 0 {
+		return ErrInvalidVolume
+	}
+
+	if !volume.Equal(volume.Truncate(int32(c.CounterScale))) {
+		return ErrVolumeScale
+	}
+
+	if c.VolumeStep.Sign() > 0 && !volume.Mod(c.VolumeStep).IsZero() {
+		return ErrVolumeStep
+	}
+
+	if c.MinVolume.Sign() > 0 && volume.LessThan(c.MinVolume) {
+		return ErrMinVolume
+	}
+
+	if c.MaxVolume.Sign() > 0 && volume.GreaterThan(c.MaxVolume) {
+		return ErrMaxVolume
+	}
+
+	return nil
+}
+
+// ValidateLimit returns an error if the limit order
+// price or volume doesn't conform.
+func (c Config) ValidateLimit(price, volume decimal.Decimal) error {
+	if err := c.ValidatePrice(price); err != nil {
+		return err
+	}
+
+	if err := c.ValidateVolume(volume); err != nil {
+		return err
+	}
+
+	if c.MinNotional.Sign() > 0 && price.Mul(volume).LessThan(c.MinNotional) {
+		return ErrMinNotional
+	}
+
+	return nil
+}
+
+// ValidateAmount returns an error if the base amount of a
+// market order doesn't conform.
+func (c Config) ValidateAmount(base decimal.Decimal) error {
+	if base.Sign() <= 0 {
+		return ErrInvalidAmount
+	}
+
+	if !base.Equal(base.Truncate(int32(c.BaseScale))) {
+		return ErrAmountScale
+	}
+
+	if c.MinNotional.Sign() > 0 && base.LessThan(c.MinNotional) {
+		return ErrMinNotional
+	}
+
+	return nil
+}
+
+// FeeRates returns the maker and taker fee rates in basis points of
+// the account. It returns the default rates if the account is not in
+// a fee tier.
+func (c Config) FeeRates(accountID int64) (maker, taker decimal.Decimal) {
+	for _, tier := range c.FeeTiers {
+		for _, id := range tier.Accounts {
+			if id == accountID {
+				return tier.MakerFeeBps, tier.TakerFeeBps
+			}
+		}
+	}
+
+	return c.MakerFeeBps, c.TakerFeeBps
+}
+
+// Fee returns the fee of the base amount at the rate in basis points.
+// Fees are rounded up to the base scale, so rebates are rounded
+// towards zero.
+func (c Config) Fee(base, bps decimal.Decimal) decimal.Decimal {
+	scale := int32(c.BaseScale)
+	return base.Mul(bps).Shift(-4).Shift(scale).Ceil().Shift(-scale)
+}
+
+// ValidateSlippage returns an error if the max slippage
+// percentage is not between 0 and 100 (exclusive).
+func ValidateSlippage(pct decimal.Decimal) error {
+	if pct.Sign() <= 0 || pct.GreaterThanOrEqual(decimal.New(100, 0)) {
+		return ErrInvalidSlippage
+	}
+
+	return nil
+}
+
+var (
+	mu      sync.RWMutex
+	configs = make(map[string]Config)
+)
+
+// Register registers the market configs replacing any existing
+// configs of the same markets.
+func Register(cl ...Config) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, c := range cl {
+		configs[c.Market] = c
+	}
+}
+
+// Lookup returns the config of the market. The default market ("")
+// returns Default if not registered. It returns ErrUnknownMarket if
+// the market is not registered.
+func Lookup(market string) (Config, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	c, ok := configs[market]
+	if ok {
+		return c, nil
+	} else if market == "" {
+		return Default, nil
+	}
+
+	return Config{}, errors.Wrap(ErrUnknownMarket, "", j.KV("market", market))
+}
+
+// Unregister removes the configs of the markets.
+func Unregister(markets ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, market := range markets {
+		delete(configs, market)
+	}
+}
+
+// Load registers the market configs in the YAML file which contains
+// a list of configs.
+func Load(path string) error {
+	cl, err := Read(path)
+	if err != nil {
+		return err
+	}
+
+	Register(cl...)
+
+	return nil
+}
+
+// Read returns the validated market configs in the YAML file which
+// contains a list of configs without registering them.
+func Read(path string) ([]Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cl []Config
+	if err := yaml.UnmarshalStrict(b, &cl); err != nil {
+		return nil, errors.Wrap(err, "invalid market config", j.KV("path", path))
+	}
+
+	seen := make(map[string]bool)
+	for _, c := range cl {
+		if seen[c.Market] {
+			return nil, errors.Wrap(ErrDuplicateMarket, "", j.KV("market", c.Market))
+		}
+		seen[c.Market] = true
+
+		if err := c.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return cl, nil
+}
+
+// Validate returns an error if the config's policies are unknown or an
+// account is in multiple fee tiers.
+func (c Config) Validate() error {
+	if !c.Allocation.Valid() {
+		return errors.Wrap(ErrUnknownAllocation, "",
+			j.MKV{"market": c.Market, "allocation": c.Allocation})
+	}
+
+	if !c.ErrorPolicy.Valid() {
+		return errors.Wrap(ErrUnknownErrorPolicy, "",
+			j.MKV{"market": c.Market, "policy": c.ErrorPolicy})
+	}
+
+	accounts := make(map[int64]bool)
+	for _, tier := range c.FeeTiers {
+		for _, id := range tier.Accounts {
+			if accounts[id] {
+				return errors.Wrap(ErrDuplicateFeeAccount, "",
+					j.MKV{"market": c.Market, "account": id})
+			}
+			accounts[id] = true
+		}
+	}
+
+	return nil
+}
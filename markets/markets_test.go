@@ -0,0 +1,152 @@
+package markets
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/luno/jettison/jtest"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	err := Load("testdata/markets.yaml")
+	jtest.Require(t, nil, err)
+	t.Cleanup(func() {
+		Unregister("BTCUSD", "ETHBTC", "LTCUSD")
+	})
+
+	btc, err := Lookup("BTCUSD")
+	jtest.Require(t, nil, err)
+	require.Equal(t, "0.5", btc.PriceTick.String())
+	require.Equal(t, 2, btc.BaseScale)
+	require.Equal(t, Default.CounterScale, btc.CounterScale)
+
+	eth, err := Lookup("ETHBTC")
+	jtest.Require(t, nil, err)
+	require.Equal(t, Default.BaseScale, eth.BaseScale)
+	require.True(t, eth.MinNotional.IsZero())
+
+	ltc, err := Lookup("LTCUSD")
+	jtest.Require(t, nil, err)
+	require.Equal(t, AllocationProRata, ltc.Allocation)
+	require.True(t, ltc.TopPriority)
+	require.Equal(t, "0.1", ltc.MinAllocation.String())
+	require.Equal(t, "10", ltc.BreakerPct.String())
+	require.Equal(t, 5*time.Minute, ltc.BreakerWindow)
+
+	maker, taker := ltc.FeeRates(1)
+	require.Equal(t, "-1", maker.String())
+	require.Equal(t, "5", taker.String())
+	maker, taker = ltc.FeeRates(8)
+	require.Equal(t, "-2.5", maker.String())
+	require.Equal(t, "2", taker.String())
+
+	def, err := Lookup("")
+	jtest.Require(t, nil, err)
+	require.Equal(t, Default, def)
+
+	_, err = Lookup("XRPUSD")
+	jtest.Require(t, ErrUnknownMarket, err)
+
+	Unregister("BTCUSD")
+	_, err = Lookup("BTCUSD")
+	jtest.Require(t, ErrUnknownMarket, err)
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		Name string
+		YAML string
+		Err  error
+	}{
+		{
+			Name: "allocation",
+			YAML: "- market: XRPUSD\n  allocation: lifo\n",
+			Err:  ErrUnknownAllocation,
+		},
+		{
+			Name: "error policy",
+			YAML: "- market: XRPUSD\n  error_policy: ignore\n",
+			Err:  ErrUnknownErrorPolicy,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			f, err := ioutil.TempFile("", "markets")
+			jtest.Require(t, nil, err)
+			defer os.Remove(f.Name())
+
+			_, err = f.WriteString(test.YAML)
+			jtest.Require(t, nil, err)
+
+			err = Load(f.Name())
+			jtest.Require(t, test.Err, err)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	c := Config{
+		PriceTick:    d("0.5"),
+		VolumeStep:   d("0.01"),
+		MinVolume:    d("0.1"),
+		MaxVolume:    d("100"),
+		MinNotional:  d("10"),
+		BaseScale:    2,
+		CounterScale: 4,
+	}
+
+	tests := []struct {
+		Name   string
+		Price  string
+		Volume string
+		Err    error
+	}{
+		{Name: "valid", Price: "100.5", Volume: "1.23"},
+		{Name: "zero price", Price: "0", Volume: "1", Err: ErrInvalidPrice},
+		{Name: "tick", Price: "100.1", Volume: "1", Err: ErrPriceTick},
+		{Name: "negative volume", Price: "100", Volume: "-1", Err: ErrInvalidVolume},
+		{Name: "scale", Price: "100", Volume: "1.00001", Err: ErrVolumeScale},
+		{Name: "step", Price: "100", Volume: "1.005", Err: ErrVolumeStep},
+		{Name: "min volume", Price: "100", Volume: "0.09", Err: ErrMinVolume},
+		{Name: "max volume", Price: "1", Volume: "100.01", Err: ErrMaxVolume},
+		{Name: "min notional", Price: "50", Volume: "0.1", Err: ErrMinNotional},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			err := c.ValidateLimit(d(test.Price), d(test.Volume))
+			jtest.Require(t, test.Err, err)
+		})
+	}
+
+	jtest.Require(t, nil, c.ValidateAmount(d("10.01")))
+	jtest.Require(t, ErrAmountScale, c.ValidateAmount(d("10.001")))
+	jtest.Require(t, ErrMinNotional, c.ValidateAmount(d("9.99")))
+	jtest.Require(t, ErrInvalidAmount, c.ValidateAmount(d("0")))
+}
+
+func TestFee(t *testing.T) {
+	c := Config{BaseScale: 2}
+
+	tests := []struct {
+		Base string
+		Bps  string
+		Fee  string
+	}{
+		{Base: "1000", Bps: "5", Fee: "0.5"},
+		{Base: "123.45", Bps: "5", Fee: "0.07"},   // 0.061725 rounded up
+		{Base: "123.45", Bps: "-1", Fee: "-0.01"}, // -0.012345 rounded towards zero
+		{Base: "123.45", Bps: "0", Fee: "0"},
+	}
+	for _, test := range tests {
+		fee := c.Fee(d(test.Base), d(test.Bps))
+		require.Equal(t, test.Fee, fee.String())
+	}
+}
+
+func d(s string) decimal.Decimal {
+	return decimal.RequireFromString(s)
+}
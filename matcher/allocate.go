@@ -0,0 +1,187 @@
+package matcher
+
+import (
+	"github.com/corverroos/exchange/markets"
+	"github.com/shopspring/decimal"
+)
+
+// allocator allocates the taker's wanted volume to the maker orders of
+// the best price level.
+type allocator interface {
+	// Allocate trades the want against the orders of the level and appends
+	// the trades to the result. It returns true if the taker was cancelled
+	// by self-trade prevention.
+	Allocate(side *side, l *level, cmd Command, want want, r *Result) bool
+}
+
+// allocatorFor returns the allocator of the market config.
+func allocatorFor(cfg markets.Config) allocator {
+	if cfg.Allocation == markets.AllocationProRata {
+		return proRata{cfg: cfg}
+	}
+
+	return fifo{cfg: cfg}
+}
+
+// fifo allocates by price-time priority; one order at a time.
+type fifo struct {
+	cfg markets.Config
+}
+
+func (f fifo) Allocate(side *side, l *level, cmd Command, want want, r *Result) bool {
+	o := l.head
+
+	if isSelfTrade(cmd, o.Order) {
+		return preventSelfTrade(side, o, cmd, want, r)
+	}
+
+	volume := want.Remaining(o.Price)
+	if volume.LessThanOrEqual(o.Remaining) {
+		// Got all wanted at this price (taker filled unless dust remains)
+		want.Fill(volume, o.Price)
+	} else {
+		// Got some wanted
+		// Filled whole order (maker filled)
+		volume = o.Remaining
+		want.Fill(volume, o.Price)
+	}
+
+	r.Trades = append(r.Trades, fillMaker(side, o, cmd, volume, f.cfg))
+
+	return false
+}
+
+// proRata allocates proportionally to the displayed volume of the orders
+// of the level, optionally filling the first order first. Allocations are
+// rounded down to the counter scale and allocations below the minimum are
+// dropped. The remainder is allocated by time priority.
+type proRata struct {
+	cfg markets.Config
+}
+
+func (p proRata) Allocate(side *side, l *level, cmd Command, want want, r *Result) bool {
+	// Self-trades are prevented before the level is allocated.
+	for e := l.head; e != nil; e = e.next {
+		if isSelfTrade(cmd, e.Order) {
+			return preventSelfTrade(side, e, cmd, want, r)
+		}
+	}
+
+	var (
+		entries []*entry
+		total   decimal.Decimal
+	)
+	for e := l.head; e != nil; e = e.next {
+		entries = append(entries, e)
+		total = total.Add(e.Remaining)
+	}
+
+	volume := want.Remaining(l.price)
+
+	var allocs []decimal.Decimal
+	if volume.GreaterThanOrEqual(total) {
+		// Fill the whole level.
+		for _, e := range entries {
+			allocs = append(allocs, e.Remaining)
+		}
+	} else {
+		allocs = p.allocate(entries, volume)
+	}
+
+	for i, e := range entries {
+		if allocs[i].Sign() == 0 {
+			continue
+		}
+		r.Trades = append(r.Trades, fillMaker(side, e, cmd, allocs[i], p.cfg))
+	}
+
+	want.Fill(decimal.Min(volume, total), l.price)
+
+	return false
+}
+
+// allocate returns the allocations of the volume to the entries.
+// The volume must be less than the total remaining of the entries.
+func (p proRata) allocate(entries []*entry, volume decimal.Decimal) []decimal.Decimal {
+	allocs := make([]decimal.Decimal, len(entries))
+
+	var start int
+	if p.cfg.TopPriority {
+		allocs[0] = decimal.Min(volume, entries[0].Remaining)
+		volume = volume.Sub(allocs[0])
+		start = 1
+	}
+
+	var total decimal.Decimal
+	for _, e := range entries[start:] {
+		total = total.Add(e.Remaining)
+	}
+
+	remainder := volume
+	for i := start; i < len(entries) && volume.Sign() > 0; i++ {
+		// Truncated quotient ensures allocations never exceed the volume.
+		a, _ := volume.Mul(entries[i].Remaining).QuoRem(total, int32(p.cfg.CounterScale))
+		if a.LessThan(p.cfg.MinAllocation) {
+			continue
+		}
+		allocs[i] = a
+		remainder = remainder.Sub(a)
+	}
+
+	// Allocate the remainder by time priority.
+	for i, e := range entries {
+		if remainder.Sign() == 0 {
+			break
+		}
+		add := decimal.Min(remainder, e.Remaining.Sub(allocs[i]))
+		allocs[i] = allocs[i].Add(add)
+		remainder = remainder.Sub(add)
+	}
+
+	return allocs
+}
+
+// fees returns the maker and taker fees of the trade at the
+// accounts' fee rates.
+func fees(t Trade, maker, taker int64, cfg markets.Config) (decimal.Decimal, decimal.Decimal) {
+	makerBps, _ := cfg.FeeRates(maker)
+	_, takerBps := cfg.FeeRates(taker)
+	if makerBps.IsZero() && takerBps.IsZero() {
+		return decimal.Zero, decimal.Zero
+	}
+
+	base := t.Price.Mul(t.Volume)
+
+	return cfg.Fee(base, makerBps), cfg.Fee(base, takerBps)
+}
+
+// fillMaker trades the volume with the maker order entry and returns the
+// trade. Filled iceberg slices are replenished from hidden volume,
+// other filled orders are removed from the book.
+func fillMaker(side *side, o *entry, cmd Command, volume decimal.Decimal,
+	cfg markets.Config) Trade {
+
+	t := Trade{
+		MakerOrderID: o.ID,
+		TakerOrderID: cmd.OrderID,
+		Price:        o.Price,
+		Volume:       volume,
+		IsBuy:        cmd.IsBuy,
+	}
+	t.MakerFee, t.TakerFee = fees(t, o.AccountID, cmd.AccountID, cfg)
+
+	o.Remaining = o.Remaining.Sub(volume)
+	if o.Remaining.Sign() > 0 {
+		return t
+	}
+
+	if o.Hidden.Sign() > 0 {
+		// Iceberg slice filled, replenish from hidden.
+		side.Replenish(o)
+	} else {
+		t.MakerFilled = true
+		side.Remove(o)
+	}
+
+	return t
+}
@@ -0,0 +1,242 @@
+package matcher
+
+import (
+	"github.com/corverroos/exchange/markets"
+	"github.com/shopspring/decimal"
+)
+
+// Indicative returns the price and volume the auction would execute at if
+// uncrossed now. It returns zeros if the order book is not in auction or
+// if no orders cross.
+func (b *OrderBook) Indicative() (price, volume decimal.Decimal) {
+	if b.state != StateAuction {
+		return decimal.Zero, decimal.Zero
+	}
+
+	return clearingPrice(b)
+}
+
+// accumulateLimit adds the limit order to the book during an auction
+// without matching. Only good-till-cancelled orders are accepted.
+func accumulateLimit(book *OrderBook, cmd Command) Result {
+	if cmd.TimeInForce != TimeInForceGTC {
+		return Result{Type: TypeRejected, Reason: ReasonAuction}
+	}
+
+	pushLimit(book, cmd, cmd.LimitVolume)
+
+	return Result{Type: TypePosted}
+}
+
+// uncross executes the auction at the clearing price and moves the order
+// book back to continuous state. Crossing orders are matched in price-time
+// priority, the newer order of each pair being the taker. Orders of the
+// same account don't trade, the taker's self-trade prevention mode applies
+// instead, so less than the clearing volume may execute.
+func uncross(book *OrderBook, cfg markets.Config) Result {
+	book.state = StateContinuous
+
+	price, volume := clearingPrice(book)
+	if volume.Sign() == 0 {
+		return Result{Type: TypeUncrossed}
+	}
+
+	bids := crossing(book.side(true), price)
+	asks := crossing(book.side(false), price)
+
+	bidLeft := totals(bids)
+	askLeft := totals(asks)
+
+	r := Result{Type: TypeUncrossed, Price: price}
+
+	var i, j int
+	for volume.Sign() > 0 && i < len(bids) && j < len(asks) {
+		bid, ask := bids[i], asks[j]
+
+		if bid.AccountID != 0 && bid.AccountID == ask.AccountID {
+			preventAuctionSelfTrade(&bidLeft[i], &askLeft[j], bid, ask, &r)
+		} else {
+			v := decimal.Min(volume, decimal.Min(bidLeft[i], askLeft[j]))
+			volume = volume.Sub(v)
+			bidLeft[i] = bidLeft[i].Sub(v)
+			askLeft[j] = askLeft[j].Sub(v)
+
+			bidFilled, askFilled := bidLeft[i].Sign() == 0, askLeft[j].Sign() == 0
+
+			t := Trade{
+				Volume: v,
+				Price:  price,
+			}
+			if bid.ID > ask.ID {
+				t.MakerOrderID, t.TakerOrderID = ask.ID, bid.ID
+				t.MakerFilled, t.TakerFilled = askFilled, bidFilled
+				t.IsBuy = true
+				t.MakerFee, t.TakerFee = fees(t, ask.AccountID, bid.AccountID, cfg)
+			} else {
+				t.MakerOrderID, t.TakerOrderID = bid.ID, ask.ID
+				t.MakerFilled, t.TakerFilled = bidFilled, askFilled
+				t.MakerFee, t.TakerFee = fees(t, bid.AccountID, ask.AccountID, cfg)
+			}
+			r.Trades = append(r.Trades, t)
+		}
+
+		if bidLeft[i].Sign() == 0 {
+			i++
+		}
+		if askLeft[j].Sign() == 0 {
+			j++
+		}
+	}
+
+	fillAuction(book.side(true), bids, bidLeft)
+	fillAuction(book.side(false), asks, askLeft)
+
+	return r
+}
+
+// preventAuctionSelfTrade applies the newer (taker) order's self-trade
+// prevention mode to the pair of crossing orders of the same account
+// instead of trading. Cancelled orders have no volume left and are added
+// to the result's cancelled list.
+func preventAuctionSelfTrade(bidLeft, askLeft *decimal.Decimal,
+	bid, ask *entry, r *Result) {
+
+	takerLeft, makerLeft := bidLeft, askLeft
+	taker, maker := bid, ask
+	if ask.ID > bid.ID {
+		takerLeft, makerLeft = askLeft, bidLeft
+		taker, maker = ask, bid
+	}
+
+	cancel := func(left *decimal.Decimal, e *entry) {
+		*left = decimal.Zero
+		r.Cancelled = append(r.Cancelled, e.ID)
+	}
+
+	switch taker.STP {
+	case STPCancelOldest:
+		cancel(makerLeft, maker)
+
+	case STPCancelBoth:
+		cancel(makerLeft, maker)
+		cancel(takerLeft, taker)
+
+	case STPDecrement:
+		// Reduce both orders by the smaller volume without trading.
+		dec := decimal.Min(*takerLeft, *makerLeft)
+		*takerLeft = takerLeft.Sub(dec)
+		*makerLeft = makerLeft.Sub(dec)
+
+		if makerLeft.Sign() == 0 {
+			r.Cancelled = append(r.Cancelled, maker.ID)
+		}
+		if takerLeft.Sign() == 0 {
+			r.Cancelled = append(r.Cancelled, taker.ID)
+		}
+
+	default: // STPCancelNewest
+		cancel(takerLeft, taker)
+	}
+}
+
+// clearingPrice returns the price that maximises the executed volume of
+// the crossing orders and that volume. Ties are broken by the smallest
+// surplus (imbalance) and then by the lowest price. Hidden iceberg volume
+// is included.
+func clearingPrice(book *OrderBook) (price, volume decimal.Decimal) {
+	bids := levelTotals(book.side(true))
+	asks := levelTotals(book.side(false))
+
+	var surplus decimal.Decimal
+	for _, candidates := range [][]PriceLevel{bids, asks} {
+		for _, c := range candidates {
+			var demand, supply decimal.Decimal
+			for _, pl := range bids {
+				if pl.Price.GreaterThanOrEqual(c.Price) {
+					demand = demand.Add(pl.Volume)
+				}
+			}
+			for _, pl := range asks {
+				if pl.Price.LessThanOrEqual(c.Price) {
+					supply = supply.Add(pl.Volume)
+				}
+			}
+
+			exec := decimal.Min(demand, supply)
+			if exec.Sign() == 0 {
+				continue
+			}
+			imbalance := demand.Sub(supply).Abs()
+
+			if cmp := exec.Cmp(volume); cmp < 0 {
+				continue
+			} else if cmp == 0 {
+				if cmp := imbalance.Cmp(surplus); cmp > 0 {
+					continue
+				} else if cmp == 0 && !c.Price.LessThan(price) {
+					continue
+				}
+			}
+
+			price, volume, surplus = c.Price, exec, imbalance
+		}
+	}
+
+	return price, volume
+}
+
+// levelTotals returns the price levels of the side including hidden
+// iceberg volume.
+func levelTotals(s *side) []PriceLevel {
+	var res []PriceLevel
+	s.Walk(func(l *level) bool {
+		pl := PriceLevel{Price: l.price}
+		for e := l.head; e != nil; e = e.next {
+			pl.Volume = pl.Volume.Add(e.Remaining).Add(e.Hidden)
+			pl.Count++
+		}
+		res = append(res, pl)
+		return true
+	})
+	return res
+}
+
+// crossing returns the entries of the side that cross the price in
+// priority order.
+func crossing(s *side, price decimal.Decimal) []*entry {
+	var res []*entry
+	s.Walk(func(l *level) bool {
+		if isInside(l.price, price, s.isBid) {
+			// Bids below or asks above the price.
+			return false
+		}
+		for e := l.head; e != nil; e = e.next {
+			res = append(res, e)
+		}
+		return true
+	})
+	return res
+}
+
+// totals returns the total remaining volume of the entries
+// including hidden iceberg volume.
+func totals(entries []*entry) []decimal.Decimal {
+	res := make([]decimal.Decimal, len(entries))
+	for i, e := range entries {
+		res[i] = e.Remaining.Add(e.Hidden)
+	}
+	return res
+}
+
+// fillAuction removes filled entries from the side and reduces
+// partially filled entries in place.
+func fillAuction(s *side, entries []*entry, left []decimal.Decimal) {
+	for i, e := range entries {
+		filled := e.Remaining.Add(e.Hidden).Sub(left[i])
+		if left[i].Sign() == 0 {
+			s.Remove(e)
+		} else if filled.Sign() > 0 {
+			e.Reduce(filled)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package matcher
+
+import (
+	"github.com/shopspring/decimal"
+)
+
+// side is one side of the order book. Orders are grouped by price into
+// levels stored in a balanced (AVL) tree. Each level is a FIFO queue of
+// orders. An index by order ID allows constant time removal.
+type side struct {
+	isBid bool
+	root  *level
+	index map[int64]*entry
+}
+
+// level is a price level queue of orders as well as a node in
+// the AVL tree of price levels.
+type level struct {
+	price      decimal.Decimal
+	head, tail *entry
+
+	left, right *level
+	height      int
+}
+
+// entry is an order in a price level queue.
+type entry struct {
+	Order
+
+	level      *level
+	prev, next *entry
+}
+
+func newSide(isBid bool) *side {
+	return &side{
+		isBid: isBid,
+		index: make(map[int64]*entry),
+	}
+}
+
+// Len returns the number of orders in the side.
+func (s *side) Len() int {
+	return len(s.index)
+}
+
+// Best returns the best price level or nil if the side is empty.
+// For bids the best price is the highest, for asks the lowest.
+func (s *side) Best() *level {
+	n := s.root
+	if n == nil {
+		return nil
+	}
+
+	for {
+		next := n.left
+		if s.isBid {
+			next = n.right
+		}
+		if next == nil {
+			return n
+		}
+		n = next
+	}
+}
+
+// Walk calls fn for each price level from best to worst price
+// until fn returns false.
+func (s *side) Walk(fn func(*level) bool) {
+	walk(s.root, s.isBid, fn)
+}
+
+// Get returns the order entry by ID or nil if not found.
+func (s *side) Get(id int64) *entry {
+	return s.index[id]
+}
+
+// Push adds the order to the back of its price level queue.
+func (s *side) Push(o Order) {
+	l := find(s.root, o.Price)
+	if l == nil {
+		l = &level{price: o.Price, height: 1}
+		s.root = insert(s.root, l)
+	}
+
+	e := &entry{Order: o, level: l}
+	l.pushBack(e)
+	s.index[o.ID] = e
+}
+
+// Remove removes the order entry from the side.
+func (s *side) Remove(e *entry) {
+	l := e.level
+	l.unlink(e)
+	delete(s.index, e.ID)
+
+	if l.head == nil {
+		s.root = remove(s.root, l.price)
+		l.left, l.right = nil, nil
+	}
+}
+
+// Replenish refills the displayed volume of the iceberg order entry from
+// its hidden volume and moves it to the back of the price level queue,
+// losing time priority.
+func (s *side) Replenish(e *entry) {
+	refill := decimal.Min(e.Display, e.Hidden)
+	e.Remaining = refill
+	e.Hidden = e.Hidden.Sub(refill)
+
+	l := e.level
+	l.unlink(e)
+	l.pushBack(e)
+}
+
+// Reduce reduces the volume of the order entry in place, retaining
+// time priority. Hidden volume is reduced first. The volume must be less
+// than the total remaining volume.
+func (e *entry) Reduce(volume decimal.Decimal) {
+	hidden := decimal.Min(volume, e.Hidden)
+	e.Hidden = e.Hidden.Sub(hidden)
+	e.Remaining = e.Remaining.Sub(volume.Sub(hidden))
+}
+
+// Depth returns up to n price levels of displayed volume.
+func (s *side) Depth(n int) []PriceLevel {
+	var res []PriceLevel
+	s.Walk(func(l *level) bool {
+		if len(res) >= n {
+			return false
+		}
+
+		pl := PriceLevel{Price: l.price}
+		for e := l.head; e != nil; e = e.next {
+			pl.Volume = pl.Volume.Add(e.Remaining)
+			pl.Count++
+		}
+		res = append(res, pl)
+		return true
+	})
+	return res
+}
+
+// Orders returns all orders in priority order.
+func (s *side) Orders() []Order {
+	res := make([]Order, 0, s.Len())
+	s.Walk(func(l *level) bool {
+		for e := l.head; e != nil; e = e.next {
+			res = append(res, e.Order)
+		}
+		return true
+	})
+	return res
+}
+
+func (l *level) pushBack(e *entry) {
+	e.prev = l.tail
+	e.next = nil
+	if l.tail != nil {
+		l.tail.next = e
+	} else {
+		l.head = e
+	}
+	l.tail = e
+}
+
+func (l *level) unlink(e *entry) {
+	if e.prev != nil {
+		e.prev.next = e.next
+	} else {
+		l.head = e.next
+	}
+	if e.next != nil {
+		e.next.prev = e.prev
+	} else {
+		l.tail = e.prev
+	}
+	e.prev, e.next = nil, nil
+}
+
+// walk traverses the tree in order (or reverse order) calling fn for each
+// node. It returns false if fn returned false.
+func walk(n *level, reverse bool, fn func(*level) bool) bool {
+	if n == nil {
+		return true
+	}
+
+	first, second := n.left, n.right
+	if reverse {
+		first, second = second, first
+	}
+
+	return walk(first, reverse, fn) && fn(n) && walk(second, reverse, fn)
+}
+
+// find returns the level with the price or nil if not found.
+func find(n *level, price decimal.Decimal) *level {
+	for n != nil {
+		c := price.Cmp(n.price)
+		if c == 0 {
+			return n
+		} else if c < 0 {
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	return nil
+}
+
+// insert inserts the level into the tree and returns the new root.
+func insert(n *level, l *level) *level {
+	if n == nil {
+		return l
+	}
+
+	if l.price.LessThan(n.price) {
+		n.left = insert(n.left, l)
+	} else {
+		n.right = insert(n.right, l)
+	}
+
+	return rebalance(n)
+}
+
+// remove removes the level with the price from the tree and returns the
+// new root. Nodes are moved, not copied, since entries reference them.
+func remove(n *level, price decimal.Decimal) *level {
+	if n == nil {
+		return nil
+	}
+
+	c := price.Cmp(n.price)
+	if c < 0 {
+		n.left = remove(n.left, price)
+	} else if c > 0 {
+		n.right = remove(n.right, price)
+	} else if n.left == nil {
+		return n.right
+	} else if n.right == nil {
+		return n.left
+	} else {
+		// Replace with the lowest level of the right subtree.
+		m := n.right
+		for m.left != nil {
+			m = m.left
+		}
+		m.right = removeMin(n.right)
+		m.left = n.left
+		n = m
+	}
+
+	return rebalance(n)
+}
+
+// removeMin removes the lowest level from the tree and returns the new root.
+func removeMin(n *level) *level {
+	if n.left == nil {
+		return n.right
+	}
+	n.left = removeMin(n.left)
+	return rebalance(n)
+}
+
+func height(n *level) int {
+	if n == nil {
+		return 0
+	}
+	return n.height
+}
+
+func (n *level) updateHeight() {
+	l, r := height(n.left), height(n.right)
+	if l > r {
+		n.height = l + 1
+	} else {
+		n.height = r + 1
+	}
+}
+
+func rotateLeft(n *level) *level {
+	r := n.right
+	n.right = r.left
+	r.left = n
+	n.updateHeight()
+	r.updateHeight()
+	return r
+}
+
+func rotateRight(n *level) *level {
+	l := n.left
+	n.left = l.right
+	l.right = n
+	n.updateHeight()
+	l.updateHeight()
+	return l
+}
+
+// rebalance restores the AVL invariant of the node and returns the
+// new subtree root.
+func rebalance(n *level) *level {
+	n.updateHeight()
+
+	switch bf := height(n.left) - height(n.right); {
+	case bf > 1:
+		if height(n.left.left) < height(n.left.right) {
+			n.left = rotateLeft(n.left)
+		}
+		return rotateRight(n)
+	case bf < -1:
+		if height(n.right.right) < height(n.right.left) {
+			n.right = rotateRight(n.right)
+		}
+		return rotateLeft(n)
+	}
+
+	return n
+}
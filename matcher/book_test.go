@@ -0,0 +1,172 @@
+package matcher
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSideVsSlice compares the price level side with the previous
+// slice based implementation using random operations.
+func TestSideVsSlice(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+
+	for _, isBid := range []bool{true, false} {
+		s := newSide(isBid)
+		var sl []Order
+		var ids []int64
+
+		for i := 0; i < 10000; i++ {
+			switch op := r.Intn(10); {
+			case op < 6:
+				o := randOrder(r, int64(i))
+				s.Push(o)
+				sl = slicePost(sl, o, isBid)
+				ids = append(ids, o.ID)
+			case op < 8 && len(ids) > 0:
+				idx := r.Intn(len(ids))
+				id := ids[idx]
+				ids = append(ids[:idx], ids[idx+1:]...)
+				s.Remove(s.Get(id))
+				sl = sliceCancel(sl, id)
+			case len(sl) > 0:
+				best := s.Best()
+				require.NotNil(t, best)
+				require.Equal(t, sl[0], best.head.Order)
+				s.Remove(best.head)
+				ids = removeID(ids, sl[0].ID)
+				sl = sl[1:]
+			}
+
+			require.Equal(t, len(sl), s.Len())
+		}
+
+		require.Equal(t, sl, s.Orders())
+	}
+}
+
+func BenchmarkPostCancel(b *testing.B) {
+	for _, n := range []int{1e4, 1e5, 1e6} {
+		r := rand.New(rand.NewSource(0))
+		orders := sortedOrders(r, n, true)
+		extra := make([]Order, 1000)
+		for i := range extra {
+			extra[i] = randOrder(r, int64(n+i))
+		}
+
+		b.Run(fmt.Sprintf("slice/%d", n), func(b *testing.B) {
+			sl := append([]Order(nil), orders...)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				o := extra[i%len(extra)]
+				sl = slicePost(sl, o, true)
+				sl = sliceCancel(sl, o.ID)
+			}
+		})
+
+		b.Run(fmt.Sprintf("tree/%d", n), func(b *testing.B) {
+			s := newSide(true)
+			for _, o := range orders {
+				s.Push(o)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				o := extra[i%len(extra)]
+				s.Push(o)
+				s.Remove(s.Get(o.ID))
+			}
+		})
+	}
+}
+
+func BenchmarkTake(b *testing.B) {
+	for _, n := range []int{1e4, 1e5, 1e6} {
+		r := rand.New(rand.NewSource(0))
+		orders := sortedOrders(r, n, true)
+
+		b.Run(fmt.Sprintf("slice/%d", n), func(b *testing.B) {
+			sl := append([]Order(nil), orders...)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Take the best order and replace it.
+				o := sl[0]
+				sl = slicePost(sl[1:], o, true)
+			}
+		})
+
+		b.Run(fmt.Sprintf("tree/%d", n), func(b *testing.B) {
+			s := newSide(true)
+			for _, o := range orders {
+				s.Push(o)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Take the best order and replace it.
+				e := s.Best().head
+				s.Remove(e)
+				s.Push(e.Order)
+			}
+		})
+	}
+}
+
+func randOrder(r *rand.Rand, id int64) Order {
+	return Order{
+		ID:        id,
+		Price:     decimal.New(int64(r.NormFloat64()*1000+100000), -2),
+		Remaining: decimal.New(int64(r.Intn(1000)+1), -2),
+	}
+}
+
+// sortedOrders returns n random orders in priority order.
+func sortedOrders(r *rand.Rand, n int, isBid bool) []Order {
+	s := newSide(isBid)
+	for i := 0; i < n; i++ {
+		s.Push(randOrder(r, int64(i)))
+	}
+	return s.Orders()
+}
+
+// slicePost is the previous slice based postLimit implementation.
+func slicePost(side []Order, o Order, isBid bool) []Order {
+	var idx int
+	for _, x := range side {
+		if isInside(x.Price, o.Price, isBid) {
+			break
+		}
+		idx++
+	}
+
+	temp := append([]Order(nil), side[:idx]...)
+	temp = append(temp, o)
+	return append(temp, side[idx:]...)
+}
+
+// sliceCancel is the previous slice based cancelOrder implementation.
+func sliceCancel(side []Order, id int64) []Order {
+	var idx int
+	for _, o := range side {
+		if o.ID == id {
+			break
+		}
+		idx++
+	}
+
+	if idx == len(side) {
+		return side
+	}
+
+	return append(side[:idx], side[idx+1:]...)
+}
+
+func removeID(ids []int64, id int64) []int64 {
+	for i, x := range ids {
+		if x == id {
+			return append(ids[:i], ids[i+1:]...)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,58 @@
+package matcher
+
+import (
+	"time"
+
+	"github.com/corverroos/exchange/markets"
+	"github.com/shopspring/decimal"
+)
+
+// reference is the circuit breaker reference price; the first trade
+// price of the current window.
+type reference struct {
+	Price decimal.Decimal
+	Time  time.Time
+}
+
+// checkBreaker halts the order book if a trade price moved more than the
+// market's breaker percentage from the reference price. The reference is
+// reset by the first trade after the window expired and when halted.
+// It returns true if the order book was halted.
+func checkBreaker(book *OrderBook, ts time.Time, tl []Trade, cfg markets.Config) bool {
+	if cfg.BreakerPct.Sign() <= 0 {
+		return false
+	}
+
+	hundred := decimal.New(100, 0)
+	for _, t := range tl {
+		ref := book.ref
+		if ref.Price.IsZero() || cfg.BreakerWindow > 0 && ts.Sub(ref.Time) > cfg.BreakerWindow {
+			book.ref = reference{Price: t.Price, Time: ts}
+			continue
+		}
+
+		move := t.Price.Sub(ref.Price).Abs().Mul(hundred).Div(ref.Price)
+		if move.GreaterThan(cfg.BreakerPct) {
+			halt(book)
+			return true
+		}
+	}
+
+	return false
+}
+
+// halt halts the order book and resets the circuit breaker reference.
+func halt(book *OrderBook) {
+	book.halted = true
+	book.ref = reference{}
+}
+
+// tradesOf returns all trades of the result including
+// those of triggered results.
+func tradesOf(r Result) []Trade {
+	tl := r.Trades
+	for _, tr := range r.Triggered {
+		tl = append(tl, tr.Trades...)
+	}
+	return tl
+}
@@ -13,11 +13,21 @@ func _() {
 	_ = x[CommandMarket-2]
 	_ = x[CommandPostOnly-3]
 	_ = x[CommandCancel-4]
+	_ = x[CommandStop-5]
+	_ = x[CommandStopLimit-6]
+	_ = x[CommandExpire-7]
+	_ = x[CommandAmend-8]
+	_ = x[CommandAuctionStart-9]
+	_ = x[CommandUncross-10]
+	_ = x[CommandHalt-11]
+	_ = x[CommandResume-12]
+	_ = x[CommandMassCancel-13]
+	_ = x[CommandInvalid-14]
 }
 
-const _CommandType_name = "UnknownLimitMarketPostOnlyCancel"
+const _CommandType_name = "UnknownLimitMarketPostOnlyCancelStopStopLimitExpireAmendAuctionStartUncrossHaltResumeMassCancelInvalid"
 
-var _CommandType_index = [...]uint8{0, 7, 12, 18, 26, 32}
+var _CommandType_index = [...]uint8{0, 7, 12, 18, 26, 32, 36, 45, 51, 56, 68, 75, 79, 85, 95, 102}
 
 func (i CommandType) String() string {
 	if i < 0 || i >= CommandType(len(_CommandType_index)-1) {
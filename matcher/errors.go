@@ -0,0 +1,13 @@
+package matcher
+
+import (
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/j"
+)
+
+var (
+	ErrUnknownCommand = errors.New("unknown command", j.C("ERR_a955d0dab3f0096f"))
+	ErrInvalidCommand = errors.New("invalid command", j.C("ERR_512b7d6073b8106c"))
+	ErrPostFailed     = errors.New("unexpected post failed", j.C("ERR_7b9e212fa8d23ee4"))
+	ErrSlideFailed    = errors.New("unexpected slide failed", j.C("ERR_451ff0d4c9d9acd3"))
+)
@@ -0,0 +1,28 @@
+package matcher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// NextHash returns the rolling hash of the result; the SHA-256 of the
+// previous hash followed by the JSON encoding of the command and the
+// result excluding its hash. Chaining the hashes allows comparing the
+// order book state of matchers per sequence.
+func NextHash(prev string, cmd Command, r Result) (string, error) {
+	r.Hash = ""
+
+	h := sha256.New()
+	h.Write([]byte(prev))
+
+	enc := json.NewEncoder(h)
+	if err := enc.Encode(cmd); err != nil {
+		return "", err
+	}
+	if err := enc.Encode(r); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
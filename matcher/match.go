@@ -1,269 +1,661 @@
 package matcher
 
 import (
-	"fmt"
-
+	"github.com/corverroos/exchange/markets"
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/j"
 	"github.com/shopspring/decimal"
 )
 
-// MatchCommand applies the command to the order book and returns
-// the match result type and any trades.
-func MatchCommand(book *OrderBook, cmd Command, scale int) (Type, []Trade) {
+// MatchCommand applies the command to the order book of the market
+// and returns the match result including any trades and triggered
+// stop orders. The circuit breaker is checked after all trades.
+// The result is chained into the order book's rolling hash.
+//
+// It returns an error if the command failed unexpectedly, in which case
+// the result (or its last triggered result) is of TypeFailed and includes
+// any trades already applied to the order book. See markets.ErrorPolicy.
+func MatchCommand(book *OrderBook, cmd Command, cfg markets.Config) (Result, error) {
+	r, err := matchCommand(book, cmd, cfg)
+	if err == nil {
+		r.Triggered, err = triggerStops(book, cmd.Sequence, r.Trades, cfg)
+	}
+
+	if err == nil && checkBreaker(book, cmd.Timestamp, tradesOf(r), cfg) {
+		r.Triggered = append(r.Triggered, Result{
+			Sequence: cmd.Sequence,
+			Type:     TypeCircuitBreaker,
+		})
+	}
+
+	if cmd.Type != CommandUnknown {
+		// Noops are excluded since they depend on other markets.
+		hash, herr := NextHash(book.hash, cmd, r)
+		if herr != nil {
+			return r, herr
+		}
+		r.Hash = hash
+		book.hash = hash
+	}
+
+	return r, err
+}
+
+// matchCommand applies the command to the order book and returns
+// the match result excluding triggered stop orders.
+func matchCommand(book *OrderBook, cmd Command, cfg markets.Config) (Result, error) {
+	r, err := applyCommand(book, cmd, cfg)
+	r.Sequence = cmd.Sequence
+	r.OrderID = cmd.OrderID
+
+	return r, err
+}
+
+// applyCommand applies the command to the order book and returns
+// the result type, any trades and orders cancelled by
+// self-trade prevention.
+func applyCommand(book *OrderBook, cmd Command, cfg markets.Config) (Result, error) {
+	if err := validate(cmd, cfg); err != nil {
+		// Defensively reject commands not conforming to the market
+		// config, amends leave the order as is.
+		if cmd.Type == CommandAmend {
+			return Result{Type: TypeAmendFailed}, nil
+		}
+		return Result{Type: TypeRejected}, nil
+	}
+
+	if book.halted {
+		// Only cancels and state commands are applied while halted.
+		switch cmd.Type {
+		case CommandLimit, CommandMarket, CommandPostOnly, CommandStop, CommandStopLimit:
+			return Result{Type: TypeRejected, Reason: ReasonHalted}, nil
+		case CommandAmend:
+			return Result{Type: TypeAmendFailed, Reason: ReasonHalted}, nil
+		case CommandUncross:
+			return Result{Type: TypeAuctionFailed, Reason: ReasonHalted}, nil
+		}
+	}
+
 	switch cmd.Type {
 
 	case CommandUnknown:
-		return TypeCommandUnknown, nil
+		return Result{Type: TypeCommandUnknown}, nil
 
 	case CommandCancel:
-		ok := cancelOrder(book, cmd)
+		ok := removeOrder(book, cmd)
+		if !ok {
+			return Result{Type: TypeCancelFailed}, nil
+		}
+		return Result{Type: TypeCancelled}, nil
+
+	case CommandExpire:
+		ok := removeOrder(book, cmd)
+		if !ok {
+			return Result{Type: TypeExpireFailed}, nil
+		}
+		return Result{Type: TypeExpired}, nil
+
+	case CommandMassCancel:
+		return Result{Type: TypeMassCancelled, Cancelled: massCancel(book, cmd)}, nil
+
+	case CommandAmend:
+		ok := amendOrder(book, cmd)
 		if !ok {
-			return TypeCancelFailed, nil
+			return Result{Type: TypeAmendFailed}, nil
+		}
+		return Result{Type: TypeAmended}, nil
+
+	case CommandAuctionStart:
+		if book.state == StateAuction && !book.halted {
+			return Result{Type: TypeAuctionFailed}, nil
+		}
+		// Halted order books re-open via the auction.
+		book.halted = false
+		book.state = StateAuction
+		return Result{Type: TypeAuctionStarted}, nil
+
+	case CommandUncross:
+		if book.state != StateAuction {
+			return Result{Type: TypeAuctionFailed}, nil
 		}
-		return TypeCancelled, nil
+		return uncross(book, cfg), nil
+
+	case CommandHalt:
+		if book.halted {
+			return Result{Type: TypeHaltFailed}, nil
+		}
+		halt(book)
+		return Result{Type: TypeHalted}, nil
+
+	case CommandResume:
+		if !book.halted {
+			return Result{Type: TypeHaltFailed}, nil
+		}
+		book.halted = false
+		return Result{Type: TypeResumed}, nil
+
+	case CommandStop, CommandStopLimit:
+		book.stops = append(book.stops, cmd)
+		return Result{Type: TypeStopAccepted}, nil
 
 	case CommandPostOnly:
 		ok := postLimit(book, cmd, cmd.LimitVolume)
-		if !ok {
-			return TypePostFailed, nil
+		if ok {
+			return Result{Type: TypePosted}, nil
+		} else if cmd.Slide {
+			return slideLimit(book, cmd, cfg)
 		}
-		return TypePosted, nil
+		return Result{Type: TypePostFailed}, nil
 
 	case CommandMarket:
-		tl, ok := applyMarket(book, cmd, scale)
-		var typ Type
-		if !ok && len(tl) == 0 {
-			typ = TypeMarketEmpty
-		} else if !ok {
-			typ = TypeMarketPartial
-		} else {
-			typ = TypeMarketFull
+		if book.state == StateAuction {
+			return Result{Type: TypeRejected, Reason: ReasonAuction}, nil
 		}
-		return typ, tl
+		return applyMarket(book, cmd, cfg), nil
 
 	case CommandLimit:
-		tl, ok := applyLimit(book, cmd)
-		var typ Type
-		if ok && len(tl) == 0 {
-			typ = TypeLimitMaker
-		} else if ok {
-			typ = TypeLimitPartial
-		} else {
-			typ = TypeLimitTaker
+		return applyLimit(book, cmd, cfg)
+
+	case CommandInvalid:
+		return Result{Type: TypeFailed}, errors.Wrap(ErrInvalidCommand, "",
+			j.MKV{"seq": cmd.Sequence, "order_id": cmd.OrderID})
+
+	default:
+		return Result{Type: TypeFailed}, errors.Wrap(ErrUnknownCommand, "",
+			j.MKV{"seq": cmd.Sequence, "type": cmd.Type})
+	}
+}
+
+// validate returns an error if the order or amend command doesn't
+// conform to the market config.
+func validate(cmd Command, cfg markets.Config) error {
+	switch cmd.Type {
+	case CommandLimit, CommandPostOnly:
+		return validateLimit(cmd, cfg)
+
+	case CommandMarket:
+		return validateMarket(cmd, cfg)
+
+	case CommandStop:
+		if err := cfg.ValidatePrice(cmd.StopPrice); err != nil {
+			return err
 		}
-		return typ, tl
+		return validateMarket(cmd, cfg)
+
+	case CommandStopLimit:
+		if err := cfg.ValidatePrice(cmd.StopPrice); err != nil {
+			return err
+		}
+		return validateLimit(cmd, cfg)
+
+	case CommandAmend:
+		return cfg.ValidateLimit(cmd.LimitPrice, cmd.LimitVolume)
 
 	default:
-		panic("unknonn command")
+		return nil
 	}
 }
 
+func validateLimit(cmd Command, cfg markets.Config) error {
+	if err := cfg.ValidateLimit(cmd.LimitPrice, cmd.LimitVolume); err != nil {
+		return err
+	}
+
+	if cmd.LimitDisplay.Sign() != 0 {
+		return cfg.ValidateVolume(cmd.LimitDisplay)
+	}
+
+	return nil
+}
+
+func validateMarket(cmd Command, cfg markets.Config) error {
+	if err := validateProtection(cmd.WorstPrice, cmd.MaxSlippage, cfg); err != nil {
+		return err
+	}
+
+	return validateAmounts(cmd.MarketBase, cmd.MarketCounter, cfg)
+}
+
+// validateAmounts returns an error if the market order doesn't
+// have either a valid base amount or counter volume.
+func validateAmounts(base, counter decimal.Decimal, cfg markets.Config) error {
+	if base.Sign() != 0 && counter.Sign() != 0 {
+		return markets.ErrAmountAndVolume
+	} else if base.Sign() != 0 {
+		return cfg.ValidateAmount(base)
+	}
+	return cfg.ValidateVolume(counter)
+}
+
+// validateProtection returns an error if the optional market order
+// price protection is invalid.
+func validateProtection(worst, slippage decimal.Decimal, cfg markets.Config) error {
+	if worst.Sign() != 0 {
+		if err := cfg.ValidatePrice(worst); err != nil {
+			return err
+		}
+	}
+
+	if slippage.Sign() != 0 {
+		return markets.ValidateSlippage(slippage)
+	}
+
+	return nil
+}
+
 // applyLimit applies the limit order to the orderbook and
-// returns any trades and true if an order was inserted in the book.
-func applyLimit(book *OrderBook, cmd Command) ([]Trade, bool) {
+// returns the result.
+func applyLimit(book *OrderBook, cmd Command, cfg markets.Config) (Result, error) {
+	if book.state == StateAuction {
+		return accumulateLimit(book, cmd), nil
+	}
+
+	if cmd.TimeInForce == TimeInForceFOK && !canFill(book, cmd) {
+		// Kill the order without touching the book.
+		return Result{Type: TypeFOKKilled}, nil
+	}
+
 	w := &wantLimit{
 		price:     cmd.LimitPrice,
 		remaining: cmd.LimitVolume,
 	}
 
-	tl := trade(book, cmd, w)
+	r := trade(book, cmd, w, allocatorFor(cfg))
+
+	if r.Type == TypeSelfTradeCancelled {
+		return r, nil
+	}
 
 	if w.IsFilled() {
-		return tl, false
+		r.Type = TypeLimitTaker
+		return r, nil
+	}
+
+	if cmd.TimeInForce != TimeInForceGTC {
+		// Drop the remaining volume.
+		r.Type = TypeIOCCancelled
+		return r, nil
 	}
 
 	ok := postLimit(book, cmd, w.remaining)
 	if !ok {
-		panic(fmt.Sprintf("unexpected post failed: %d", cmd.Sequence))
+		// Trades are retained since they were applied to the book.
+		r.Type = TypeFailed
+		return r, errors.Wrap(ErrPostFailed, "", j.KV("seq", cmd.Sequence))
 	}
 
-	return tl, true
+	if len(r.Trades) == 0 {
+		r.Type = TypeLimitMaker
+	} else {
+		r.Type = TypeLimitPartial
+	}
+
+	return r, nil
+}
+
+// canFill returns true if the limit order can be filled completely
+// by the orders in the book. It does not modify the book. Own orders
+// are skipped if self-trade prevention cancels them, otherwise they
+// block the fill.
+func canFill(book *OrderBook, cmd Command) bool {
+	need := cmd.LimitVolume
+
+	book.side(!cmd.IsBuy).Walk(func(l *level) bool {
+		if isInside(l.price, cmd.LimitPrice, !cmd.IsBuy) {
+			return false
+		}
+
+		for e := l.head; e != nil && need.Sign() > 0; e = e.next {
+			if isSelfTrade(cmd, e.Order) {
+				if cmd.STP == STPCancelOldest {
+					continue
+				}
+				return false
+			}
+			need = need.Sub(e.Remaining).Sub(e.Hidden)
+		}
+
+		return need.Sign() > 0
+	})
+
+	return need.Sign() <= 0
 }
 
 // applyMarket applies the market order to the orderbook and
-// returns any trades and true if the order was filled.
-func applyMarket(book *OrderBook, cmd Command, scale int) ([]Trade, bool) {
+// returns the result.
+func applyMarket(book *OrderBook, cmd Command, cfg markets.Config) Result {
+	limit := protectionPrice(book, cmd)
+
 	var want want
-	if cmd.IsBuy {
-		want = &wantMarketBase{remaining: cmd.MarketBase, scale: scale}
-	} else {
-		want = &wantMarketCounter{remaining: cmd.MarketCounter}
+	switch {
+	case cmd.IsBuy && cmd.MarketBase.Sign() > 0:
+		want = &wantMarketBase{remaining: cmd.MarketBase, scale: cfg.CounterScale, limit: limit}
+	case cmd.MarketBase.Sign() > 0:
+		want = &wantSellBase{remaining: cmd.MarketBase, scale: cfg.CounterScale, limit: limit}
+	default:
+		want = &wantMarketCounter{remaining: cmd.MarketCounter, limit: limit}
 	}
 
-	tl := trade(book, cmd, want)
+	r := trade(book, cmd, want, allocatorFor(cfg))
 
-	return tl, want.IsFilled()
-}
+	if r.Type == TypeSelfTradeCancelled {
+		return r
+	}
 
-// trade applies the want request to the order book and returns
-// any trades.
-func trade(book *OrderBook, cmd Command, want want) []Trade {
-	var side []Order
-	if cmd.IsBuy {
-		// Buy orders MatchCommand asks.
-		side = book.Asks
+	if !want.IsFilled() && limit.Sign() > 0 && book.side(!cmd.IsBuy).Best() != nil {
+		// Remaining orders are beyond the protection price.
+		r.Reason = ReasonPriceProtection
+	}
+
+	if want.IsFilled() {
+		r.Type = TypeMarketFull
+	} else if len(r.Trades) == 0 {
+		r.Type = TypeMarketEmpty
 	} else {
-		// Sell orders MatchCommand bids.
-		side = book.Bids
+		r.Type = TypeMarketPartial
 	}
 
-	var (
-		trades []Trade
-		pop    int // Number of orders to pop off (filled).
-	)
-	for i, o := range side {
-		// If want limit is not enough, trades are done.
-		if isInside(o, want.PriceLimit(), !cmd.IsBuy) {
+	return r
+}
+
+// protectionPrice returns the worst price the market order may trade at
+// or zero if not protected. It is the more conservative of the worst
+// price and the max slippage relative to the current best price.
+func protectionPrice(book *OrderBook, cmd Command) decimal.Decimal {
+	limit := cmd.WorstPrice
+
+	best := book.side(!cmd.IsBuy).Best()
+	if cmd.MaxSlippage.Sign() <= 0 || best == nil {
+		return limit
+	}
+
+	slip := cmd.MaxSlippage.Div(decimal.New(100, 0))
+	if !cmd.IsBuy {
+		slip = slip.Neg()
+	}
+	slipLimit := best.price.Mul(decimal.New(1, 0).Add(slip))
+
+	if limit.Sign() == 0 {
+		return slipLimit
+	} else if cmd.IsBuy {
+		return decimal.Min(limit, slipLimit)
+	}
+	return decimal.Max(limit, slipLimit)
+}
+
+// trade applies the want request to the order book and returns a result
+// with any trades allocated by the allocator. The result type is
+// TypeSelfTradeCancelled if the taker was cancelled by self-trade
+// prevention, otherwise it is unset.
+func trade(book *OrderBook, cmd Command, want want, alloc allocator) Result {
+	// Buy orders match asks, sell orders match bids.
+	side := book.side(!cmd.IsBuy)
+
+	var r Result
+	for {
+		l := side.Best()
+		if l == nil {
 			break
 		}
 
-		t := Trade{
-			MakerOrderID: o.ID,
-			TakerOrderID: cmd.OrderID,
-			Price:        o.Price,
-			IsBuy:        cmd.IsBuy,
+		// If want limit is not enough, trades are done.
+		if isInside(l.price, want.PriceLimit(), !cmd.IsBuy) {
+			break
 		}
 
-		wantRemaining := want.Remaining(o.Price)
-		diff := wantRemaining.Sub(o.Remaining)
-
-		if diff.Sign() < 0 {
-			// Got all wanted (taker filled)
-			// Filled partial order
-			want.Filled()
-			t.Volume = wantRemaining
-			side[i].Remaining = diff.Abs()
-
-		} else if diff.Sign() > 0 {
-			// Got some wanted
-			// Filled whole order (maker filled)
-			want.Fill(o.Remaining, o.Price)
-			t.Volume = o.Remaining
-			t.MakerFilled = true
-			pop++
-
-		} else /* diff.Sign() == 0 */ {
-			// Got all wanted (taker filled)
-			// Filled whole order (maker filled)
+		if want.Remaining(l.price).Sign() == 0 {
+			// The remaining amount is less than the smallest volume at
+			// the best price, leave the dust untraded.
 			want.Filled()
-			t.Volume = o.Remaining
-			t.MakerFilled = true
-			pop++
+			break
+		}
+
+		if alloc.Allocate(side, l, cmd, want, &r) {
+			r.Type = TypeSelfTradeCancelled
+			break
 		}
 
-		trades = append(trades, t)
 		if want.IsFilled() {
 			break
 		}
 	}
 
-	if cmd.IsBuy {
-		book.Asks = side[pop:]
-	} else {
-		book.Bids = side[pop:]
-	}
+	return r
+}
 
-	return trades
+// isSelfTrade returns true if the taker command and maker order
+// belong to the same account.
+func isSelfTrade(cmd Command, o Order) bool {
+	return cmd.AccountID != 0 && cmd.AccountID == o.AccountID
 }
 
-// postLimit adds the limit order to the book or returns false if
-// it would result in a trade.
-func postLimit(book *OrderBook, cmd Command, remaining decimal.Decimal) bool {
+// preventSelfTrade applies the taker's self-trade prevention mode to the
+// maker order entry instead of trading. Maker orders removed from the book
+// are added to the result's cancelled list. It returns true if the taker
+// is cancelled.
+func preventSelfTrade(side *side, o *entry, cmd Command, want want, r *Result) bool {
+	cancelMaker := func() {
+		side.Remove(o)
+		r.Cancelled = append(r.Cancelled, o.ID)
+	}
 
-	if cmd.IsBuy {
-		// Check if buy order matches lowest ask.
-		if len(book.Asks) > 0 &&
-			!isInside(book.Asks[0], cmd.LimitPrice, false) {
-			return false
+	switch cmd.STP {
+	case STPCancelOldest:
+		cancelMaker()
+		return false
+
+	case STPCancelBoth:
+		cancelMaker()
+		return true
+
+	case STPDecrement:
+		// Reduce both orders by the smaller volume without trading.
+		wantRemaining := want.Remaining(o.Price)
+		total := o.Remaining.Add(o.Hidden)
+		dec := decimal.Min(wantRemaining, total)
+
+		if dec.Equal(total) {
+			cancelMaker()
+		} else {
+			o.Reduce(dec)
 		}
-	} else {
-		// Check if sell order matches highest bid.
-		if len(book.Bids) > 0 &&
-			!isInside(book.Bids[0], cmd.LimitPrice, true) {
-			return false
+
+		if dec.Equal(wantRemaining) {
+			want.Filled()
+			return true
 		}
-	}
+		want.Fill(dec, o.Price)
+		return false
 
-	var side []Order
-	if cmd.IsBuy {
-		// Buy limit orders are posted to bids.
-		side = book.Bids
-	} else {
-		// Sell limit orders are posted to asks.
-		side = book.Asks
+	default: // STPCancelNewest
+		return true
 	}
+}
 
-	// Find index to insert at.
-	var idx int
-	for _, o := range side {
-		if isInside(o, cmd.LimitPrice, cmd.IsBuy) {
-			break
-		}
-		idx++
+// postLimit adds the limit order to the book or returns false if
+// it would result in a trade.
+func postLimit(book *OrderBook, cmd Command, remaining decimal.Decimal) bool {
+	// Check if buy order matches lowest ask or sell order matches highest bid.
+	best := book.side(!cmd.IsBuy).Best()
+	if best != nil && !isInside(best.price, cmd.LimitPrice, !cmd.IsBuy) {
+		return false
 	}
 
+	pushLimit(book, cmd, remaining)
+
+	return true
+}
+
+// pushLimit adds the limit order to the book without checking
+// if it crosses.
+func pushLimit(book *OrderBook, cmd Command, remaining decimal.Decimal) {
 	o := Order{
 		ID:        cmd.OrderID,
+		AccountID: cmd.AccountID,
+		STP:       cmd.STP,
 		Price:     cmd.LimitPrice,
 		Remaining: remaining,
 	}
 
-	temp := append([]Order(nil), side[:idx]...)
-	temp = append(temp, o)
-	temp = append(temp, side[idx:]...)
+	if cmd.LimitDisplay.Sign() > 0 && remaining.GreaterThan(cmd.LimitDisplay) {
+		// Iceberg order only displays a slice.
+		o.Display = cmd.LimitDisplay
+		o.Remaining = cmd.LimitDisplay
+		o.Hidden = remaining.Sub(cmd.LimitDisplay)
+	}
+
+	// Buy limit orders are posted to bids, sell limit orders to asks.
+	book.side(cmd.IsBuy).Push(o)
+}
+
+// slideLimit posts the crossing post only order one tick behind the best
+// opposite price. If the market has no price tick, the smallest base
+// scale increment is used.
+func slideLimit(book *OrderBook, cmd Command, cfg markets.Config) (Result, error) {
+	tick := cfg.PriceTick
+	if tick.Sign() == 0 {
+		tick = decimal.New(1, -int32(cfg.BaseScale))
+	}
+
+	best := book.side(!cmd.IsBuy).Best()
 	if cmd.IsBuy {
-		book.Bids = temp
+		cmd.LimitPrice = best.price.Sub(tick)
 	} else {
-		book.Asks = temp
+		cmd.LimitPrice = best.price.Add(tick)
 	}
-	return true
+
+	if cmd.LimitPrice.Sign() <= 0 {
+		return Result{Type: TypePostFailed}, nil
+	}
+
+	ok := postLimit(book, cmd, cmd.LimitVolume)
+	if !ok {
+		return Result{Type: TypeFailed}, errors.Wrap(ErrSlideFailed, "",
+			j.KV("seq", cmd.Sequence))
+	}
+
+	return Result{Type: TypePostSlid, Price: cmd.LimitPrice}, nil
+}
+
+// removeOrder returns true if the order or dormant stop order
+// was removed from the book.
+func removeOrder(book *OrderBook, cmd Command) bool {
+	return cancelOrder(book, cmd) || cancelStop(book, cmd)
 }
 
 // cancelOrder returns true if the order was removed from the book.
 func cancelOrder(book *OrderBook, cmd Command) bool {
-	var side []Order
-	if cmd.IsBuy {
-		// Buy limit orders are posted to bids.
-		side = book.Bids
-	} else {
-		// Sell limit orders are posted to asks.
-		side = book.Asks
+	// Buy limit orders are posted to bids, sell limit orders to asks.
+	side := book.side(cmd.IsBuy)
+
+	e := side.Get(cmd.OrderID)
+	if e == nil {
+		// Not found
+		return false
 	}
 
-	// Find the order to cancel.
-	var idx int
-	for _, o := range side {
-		if o.ID == cmd.OrderID {
-			break
+	side.Remove(e)
+
+	return true
+}
+
+// massCancel removes the orders and dormant stop orders selected by the
+// command's filter and returns their IDs in priority order; bids, asks
+// then stops.
+func massCancel(book *OrderBook, cmd Command) []int64 {
+	var f CancelFilter
+	if cmd.Filter != nil {
+		f = *cmd.Filter
+	}
+
+	var ids []int64
+	for _, isBid := range []bool{true, false} {
+		side := book.side(isBid)
+		for _, o := range side.Orders() {
+			if !f.Matches(o.AccountID, isBid, o.Price) {
+				continue
+			}
+			side.Remove(side.Get(o.ID))
+			ids = append(ids, o.ID)
 		}
-		idx++
 	}
 
-	// Not found
-	if idx == len(side) {
+	var dormant []Command
+	for _, stop := range book.stops {
+		if f.Matches(stop.AccountID, stop.IsBuy, stop.StopPrice) {
+			ids = append(ids, stop.OrderID)
+			continue
+		}
+		dormant = append(dormant, stop)
+	}
+	book.stops = dormant
+
+	return ids
+}
+
+// amendOrder returns true if the order's price and volume was amended.
+// Reducing the volume at the same price retains time priority, otherwise
+// the order is moved to the back of its (new) price level queue.
+// It fails if the order is not in the book, if the volume change would
+// leave nothing remaining or if the new price would result in a trade
+// (unless in auction).
+func amendOrder(book *OrderBook, cmd Command) bool {
+	side := book.side(cmd.IsBuy)
+
+	e := side.Get(cmd.OrderID)
+	if e == nil {
+		// Not found, probably already filled.
 		return false
 	}
 
-	// Remove from the book.
-	temp := append(side[:idx], side[idx+1:]...)
-	if cmd.IsBuy {
-		book.Bids = temp
-	} else {
-		book.Asks = temp
+	if cmd.LimitPrice.Sign() <= 0 {
+		// Invalid price, leave the order as is.
+		return false
 	}
 
+	remaining := e.Remaining.Add(e.Hidden).Add(cmd.VolumeDelta)
+	if remaining.Sign() <= 0 {
+		return false
+	}
+
+	if e.Price.Equal(cmd.LimitPrice) && cmd.VolumeDelta.Sign() <= 0 {
+		e.Reduce(cmd.VolumeDelta.Neg())
+		return true
+	}
+
+	// Check if buy order matches lowest ask or sell order matches highest bid.
+	best := book.side(!cmd.IsBuy).Best()
+	if book.state != StateAuction && best != nil &&
+		!isInside(best.price, cmd.LimitPrice, !cmd.IsBuy) {
+		return false
+	}
+
+	side.Remove(e)
+
+	repost := Command{
+		IsBuy:        cmd.IsBuy,
+		OrderID:      cmd.OrderID,
+		AccountID:    e.AccountID,
+		STP:          e.STP,
+		LimitPrice:   cmd.LimitPrice,
+		LimitDisplay: e.Display,
+	}
+
+	pushLimit(book, repost, remaining)
+
 	return true
 }
 
-// isInside returns true if the price is "inside" the order.
+// isInside returns true if the price is "inside" the order price x.
 // For bids the inside price is higher.
 // For asks the inside price is lower.
 // A zero price returns false.
-func isInside(x Order, price decimal.Decimal, isBid bool) bool {
+func isInside(x, price decimal.Decimal, isBid bool) bool {
 	if price.Sign() == 0 {
 		return false
 	}
 
-	diff := x.Price.Cmp(price)
+	diff := x.Cmp(price)
 	if diff == 0 {
 		// Equal, so not inside.
 		return false
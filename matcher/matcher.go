@@ -2,19 +2,25 @@ package matcher
 
 import (
 	"context"
+	"time"
 
+	"github.com/corverroos/exchange/markets"
 	"github.com/luno/jettison/errors"
 	"github.com/luno/jettison/j"
 )
 
-// Match applies commands to the order book and outputs
+// Match applies commands to the market's order book and outputs
 // results including trades. The order book and input commands
 // should be sequential. The snap function allows taking
 // snapshots of the order book. The latency function allows
 // measuring MatchCommand latency.
+//
+// Commands that fail unexpectedly either stop matching with the error
+// or output a TypeFailed result and continue, depending on the market's
+// error policy.
 func Match(ctx context.Context, book OrderBook,
 	input <-chan Command, output chan<- Result,
-	scale int, snap func(*OrderBook), latency func() func()) error {
+	cfg markets.Config, snap func(*OrderBook), latency func() func()) error {
 
 	for {
 		var cmd Command
@@ -26,11 +32,14 @@ func Match(ctx context.Context, book OrderBook,
 
 		if cmd.Sequence <= book.Sequence {
 			// Ignore old commands
-			output <- Result{
+			r := Result{
 				Sequence: cmd.Sequence,
 				OrderID:  cmd.OrderID,
 				Type:     TypeCommandOld,
 			}
+			if err := send(ctx, output, r); err != nil {
+				return err
+			}
 			continue
 		} else if cmd.Sequence > book.Sequence+1 {
 			return errors.New("out of order command",
@@ -38,19 +47,39 @@ func Match(ctx context.Context, book OrderBook,
 		}
 
 		l := latency()
-		typ, tl := MatchCommand(&book, cmd, scale)
+		r, err := MatchCommand(&book, cmd, cfg)
 		l()
 
+		if err != nil && cfg.ErrorPolicy != markets.ErrorPolicyReject {
+			return err
+		}
+
 		book.Sequence = cmd.Sequence
 
-		output <- Result{
-			Sequence: cmd.Sequence,
-			OrderID:  cmd.OrderID,
-			Type:     typ,
-			Trades:   tl,
+		if err := send(ctx, output, r); err != nil {
+			return err
 		}
 
 		// Call some metrics
 		snap(&book)
 	}
 }
+
+// send outputs the result stamped with the match time, returning early
+// if the context is done while blocked.
+func send(ctx context.Context, output chan<- Result, r Result) error {
+	r.MatchedAt = time.Now()
+
+	select {
+	case output <- r:
+		return nil
+	default:
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case output <- r:
+		return nil
+	}
+}
@@ -2,10 +2,13 @@ package matcher
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/corverroos/exchange/markets"
 	"github.com/luno/jettison/errors"
 	"github.com/luno/jettison/j"
 	"github.com/luno/jettison/jtest"
@@ -341,7 +344,1645 @@ func TestMarketBase2(t *testing.T) {
 	testMatch(t, cmds)
 }
 
+func TestStop(t *testing.T) {
+	cmds := []Command{{ /* CommandOld*/ },
+		{
+			// LimitMaker Ask:1@10
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+			IsBuy:       false,
+		},
+		{
+			// LimitMaker Ask:1@11
+			Type:        CommandLimit,
+			LimitPrice:  d(11),
+			LimitVolume: d(1),
+			IsBuy:       false,
+		},
+		{
+			// LimitMaker Bid:1@9
+			Type:        CommandLimit,
+			LimitPrice:  d(9),
+			LimitVolume: d(1),
+			IsBuy:       true,
+		},
+		{
+			// LimitMaker Bid:1@8
+			Type:        CommandLimit,
+			LimitPrice:  d(8),
+			LimitVolume: d(1),
+			IsBuy:       true,
+		},
+		{
+			// StopAccepted Buy stop 10
+			Type:       CommandStop,
+			StopPrice:  d(10),
+			MarketBase: d(11),
+			IsBuy:      true,
+		},
+		{
+			// StopAccepted Sell stop 9 limit 2@8
+			Type:        CommandStopLimit,
+			StopPrice:   d(9),
+			LimitPrice:  d(8),
+			LimitVolume: d(2),
+			IsBuy:       false,
+		},
+		{
+			// StopAccepted Buy stop 20 limit 1@20
+			Type:        CommandStopLimit,
+			StopPrice:   d(20),
+			LimitPrice:  d(20),
+			LimitVolume: d(1),
+			IsBuy:       true,
+		},
+		{
+			// Cancelled stop
+			Type:    CommandCancel,
+			OrderID: 7,
+			IsBuy:   true,
+		},
+		{
+			// MarketFull triggers buy stop 10: MarketFull
+			Type:       CommandMarket,
+			MarketBase: d(10),
+			IsBuy:      true,
+		},
+		{
+			// MarketFull triggers sell stop 9: LimitPartial
+			Type:          CommandMarket,
+			MarketCounter: d(1),
+			IsBuy:         false,
+		},
+	}
+	testMatch(t, cmds)
+}
+
+func TestTimeInForce(t *testing.T) {
+	cmds := []Command{{ /* CommandOld*/ },
+		{
+			// LimitMaker Ask:1@10
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+			IsBuy:       false,
+		},
+		{
+			// LimitMaker Ask:1@11
+			Type:        CommandLimit,
+			LimitPrice:  d(11),
+			LimitVolume: d(1),
+			IsBuy:       false,
+		},
+		{
+			// IOCCancelled after taking Ask:1@10
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(3),
+			IsBuy:       true,
+			TimeInForce: TimeInForceIOC,
+		},
+		{
+			// IOCCancelled without trades
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+			IsBuy:       true,
+			TimeInForce: TimeInForceIOC,
+		},
+		{
+			// LimitMaker Ask:1@12
+			Type:        CommandLimit,
+			LimitPrice:  d(12),
+			LimitVolume: d(1),
+			IsBuy:       false,
+		},
+		{
+			// FOKKilled, book untouched
+			Type:        CommandLimit,
+			LimitPrice:  d(12),
+			LimitVolume: d(3),
+			IsBuy:       true,
+			TimeInForce: TimeInForceFOK,
+		},
+		{
+			// LimitTaker Ask:1@11 and Ask:1@12
+			Type:        CommandLimit,
+			LimitPrice:  d(12),
+			LimitVolume: d(2),
+			IsBuy:       true,
+			TimeInForce: TimeInForceFOK,
+		},
+		{
+			// FOKKilled on empty book
+			Type:        CommandLimit,
+			LimitPrice:  d(1),
+			LimitVolume: d(1),
+			IsBuy:       false,
+			TimeInForce: TimeInForceFOK,
+		},
+	}
+	testMatch(t, cmds)
+}
+
+func TestExpire(t *testing.T) {
+	cmds := []Command{{ /* CommandOld*/ },
+		{
+			// LimitMaker Ask:1@10
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+			IsBuy:       false,
+		},
+		{
+			// LimitMaker Ask:1@11
+			Type:        CommandLimit,
+			LimitPrice:  d(11),
+			LimitVolume: d(1),
+			IsBuy:       false,
+		},
+		{
+			// Expired
+			Type:    CommandExpire,
+			OrderID: 2,
+			IsBuy:   false,
+		},
+		{
+			// LimitTaker Ask:1@10
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+			IsBuy:       true,
+		},
+		{
+			// ExpireFailed, already filled
+			Type:    CommandExpire,
+			OrderID: 1,
+			IsBuy:   false,
+		},
+	}
+	testMatch(t, cmds)
+}
+
+func TestIceberg(t *testing.T) {
+	cmds := []Command{{ /* CommandOld*/ },
+		{
+			// LimitMaker Ask:1(+4)@10
+			Type:         CommandLimit,
+			LimitPrice:   d(10),
+			LimitVolume:  d(5),
+			LimitDisplay: d(1),
+			IsBuy:        false,
+		},
+		{
+			// LimitMaker Ask:1@10
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+			IsBuy:       false,
+		},
+		{
+			// LimitTaker: Iceberg replenished and loses priority
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(2),
+			IsBuy:       true,
+		},
+		{
+			// MarketFull: Iceberg replenished twice
+			Type:       CommandMarket,
+			MarketBase: d(25),
+			IsBuy:      true,
+		},
+		{
+			// FOKKilled: Only 1.5 available including hidden
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(2),
+			IsBuy:       true,
+			TimeInForce: TimeInForceFOK,
+		},
+		{
+			// LimitTaker: Iceberg filled
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: decimal.New(15, -1),
+			IsBuy:       true,
+		},
+	}
+	testMatch(t, cmds)
+}
+
+func TestAmend(t *testing.T) {
+	cmds := []Command{{ /* CommandOld*/ },
+		{
+			// LimitMaker Ask:2@10
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(2),
+			IsBuy:       false,
+		},
+		{
+			// LimitMaker Ask:1@10
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+			IsBuy:       false,
+		},
+		{
+			// LimitMaker Bid:1@8
+			Type:        CommandLimit,
+			LimitPrice:  d(8),
+			LimitVolume: d(1),
+			IsBuy:       true,
+		},
+		{
+			// Amended: Reduced in place, keeps priority
+			Type:        CommandAmend,
+			OrderID:     1,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+			VolumeDelta: d(-1),
+			IsBuy:       false,
+		},
+		{
+			// Amended: Increased, loses priority
+			Type:        CommandAmend,
+			OrderID:     1,
+			LimitPrice:  d(10),
+			LimitVolume: d(2),
+			VolumeDelta: d(1),
+			IsBuy:       false,
+		},
+		{
+			// AmendFailed: Price crosses the asks
+			Type:        CommandAmend,
+			OrderID:     3,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+			IsBuy:       true,
+		},
+		{
+			// Amended: New price and volume
+			Type:        CommandAmend,
+			OrderID:     3,
+			LimitPrice:  d(9),
+			LimitVolume: d(2),
+			VolumeDelta: d(1),
+			IsBuy:       true,
+		},
+		{
+			// AmendFailed: Nothing remaining
+			Type:        CommandAmend,
+			OrderID:     2,
+			LimitPrice:  d(10),
+			VolumeDelta: d(-1),
+			IsBuy:       false,
+		},
+		{
+			// MarketFull: Fills order 2
+			Type:       CommandMarket,
+			MarketBase: d(10),
+			IsBuy:      true,
+		},
+		{
+			// AmendFailed: Already filled
+			Type:        CommandAmend,
+			OrderID:     2,
+			LimitPrice:  d(11),
+			LimitVolume: d(1),
+			IsBuy:       false,
+		},
+		{
+			// LimitMaker Ask:4@12 (1 displayed)
+			Type:         CommandLimit,
+			LimitPrice:   d(12),
+			LimitVolume:  d(4),
+			LimitDisplay: d(1),
+			IsBuy:        false,
+		},
+		{
+			// Amended: Iceberg reduced from hidden volume
+			Type:        CommandAmend,
+			OrderID:     11,
+			LimitPrice:  d(12),
+			LimitVolume: d(2),
+			VolumeDelta: d(-2),
+			IsBuy:       false,
+		},
+		{
+			// AmendFailed: Invalid price, order remains
+			Type:        CommandAmend,
+			OrderID:     3,
+			LimitVolume: d(2),
+			IsBuy:       true,
+		},
+	}
+	testMatch(t, cmds)
+}
+
+func TestSelfTrade(t *testing.T) {
+	cmds := []Command{{ /* CommandOld*/ },
+		{
+			// LimitMaker Ask:1@10 (A)
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+			AccountID:   1,
+		},
+		{
+			// LimitMaker Ask:1@10 (B)
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+			AccountID:   2,
+		},
+		{
+			// SelfTradeCancelled: Cancel newest (A)
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(2),
+			IsBuy:       true,
+			AccountID:   1,
+		},
+		{
+			// LimitTaker: Cancel oldest (A), trades with B
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+			IsBuy:       true,
+			AccountID:   1,
+			STP:         STPCancelOldest,
+		},
+		{
+			// LimitMaker Ask:2@11 (A)
+			Type:        CommandLimit,
+			LimitPrice:  d(11),
+			LimitVolume: d(2),
+			AccountID:   1,
+		},
+		{
+			// LimitMaker Ask:1@12 (B)
+			Type:        CommandLimit,
+			LimitPrice:  d(12),
+			LimitVolume: d(1),
+			AccountID:   2,
+		},
+		{
+			// SelfTradeCancelled: Cancel both (A)
+			Type:       CommandMarket,
+			MarketBase: d(100),
+			IsBuy:      true,
+			AccountID:  1,
+			STP:        STPCancelBoth,
+		},
+		{
+			// LimitMaker Ask:3@11 (A)
+			Type:        CommandLimit,
+			LimitPrice:  d(11),
+			LimitVolume: d(3),
+			AccountID:   1,
+		},
+		{
+			// SelfTradeCancelled: Decrement maker (A)
+			Type:        CommandLimit,
+			LimitPrice:  d(12),
+			LimitVolume: d(1),
+			IsBuy:       true,
+			AccountID:   1,
+			STP:         STPDecrement,
+		},
+		{
+			// LimitPartial: Decrement taker (A), trades with B
+			Type:        CommandLimit,
+			LimitPrice:  d(12),
+			LimitVolume: d(4),
+			IsBuy:       true,
+			AccountID:   1,
+			STP:         STPDecrement,
+		},
+		{
+			// FOKKilled: Only own bids
+			Type:        CommandLimit,
+			LimitPrice:  d(12),
+			LimitVolume: d(1),
+			AccountID:   1,
+			TimeInForce: TimeInForceFOK,
+		},
+		{
+			// LimitTaker: Different account
+			Type:        CommandLimit,
+			LimitPrice:  d(12),
+			LimitVolume: d(1),
+			AccountID:   2,
+		},
+	}
+	testMatch(t, cmds)
+}
+
+func TestPriceProtection(t *testing.T) {
+	cmds := []Command{{ /* CommandOld*/ },
+		{
+			// LimitMaker Ask:1@10
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+		},
+		{
+			// LimitMaker Ask:1@11
+			Type:        CommandLimit,
+			LimitPrice:  d(11),
+			LimitVolume: d(1),
+		},
+		{
+			// LimitMaker Ask:1@20
+			Type:        CommandLimit,
+			LimitPrice:  d(20),
+			LimitVolume: d(1),
+		},
+		{
+			// MarketPartial: Worst price 11
+			Type:       CommandMarket,
+			MarketBase: d(100),
+			IsBuy:      true,
+			WorstPrice: d(11),
+		},
+		{
+			// LimitMaker Ask:1@10
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+		},
+		{
+			// MarketPartial: Max slippage 5% (10.5)
+			Type:        CommandMarket,
+			MarketBase:  d(100),
+			IsBuy:       true,
+			MaxSlippage: d(5),
+		},
+		{
+			// MarketEmpty: No bids
+			Type:          CommandMarket,
+			MarketCounter: d(1),
+			WorstPrice:    d(9),
+		},
+		{
+			// LimitMaker Bid:1@8
+			Type:        CommandLimit,
+			LimitPrice:  d(8),
+			LimitVolume: d(1),
+			IsBuy:       true,
+		},
+		{
+			// MarketEmpty: Worst price 9
+			Type:          CommandMarket,
+			MarketCounter: d(1),
+			WorstPrice:    d(9),
+		},
+		{
+			// MarketFull: Max slippage 1% (20.2), worst price 30
+			Type:        CommandMarket,
+			MarketBase:  d(20),
+			IsBuy:       true,
+			MaxSlippage: d(1),
+			WorstPrice:  d(30),
+		},
+	}
+	testMatch(t, cmds)
+}
+
+func TestRejected(t *testing.T) {
+	cfg := markets.Config{
+		PriceTick:    decimal.New(5, -1),
+		VolumeStep:   decimal.New(1, -1),
+		MinVolume:    decimal.New(1, -1),
+		MaxVolume:    d(10),
+		MinNotional:  d(1),
+		BaseScale:    2,
+		CounterScale: 2,
+	}
+
+	cmds := []Command{{ /* CommandOld*/ },
+		{
+			// LimitMaker Ask:1@10
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+		},
+		{
+			// Rejected: Price tick
+			Type:        CommandLimit,
+			LimitPrice:  decimal.New(102, -1),
+			LimitVolume: d(1),
+			IsBuy:       true,
+		},
+		{
+			// Rejected: Volume step
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: decimal.New(15, -2),
+			IsBuy:       true,
+		},
+		{
+			// Rejected: Max volume
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(11),
+			IsBuy:       true,
+		},
+		{
+			// Rejected: Min notional
+			Type:        CommandPostOnly,
+			LimitPrice:  d(5),
+			LimitVolume: decimal.New(1, -1),
+			IsBuy:       true,
+		},
+		{
+			// Rejected: Base scale
+			Type:       CommandMarket,
+			MarketBase: decimal.New(1001, -3),
+			IsBuy:      true,
+		},
+		{
+			// Rejected: Iceberg display volume step
+			Type:         CommandLimit,
+			LimitPrice:   d(5),
+			LimitVolume:  d(1),
+			LimitDisplay: decimal.New(5, -2),
+			IsBuy:        true,
+		},
+		{
+			// AmendFailed: Price tick, order remains
+			Type:        CommandAmend,
+			OrderID:     1,
+			LimitPrice:  decimal.New(101, -1),
+			LimitVolume: d(1),
+		},
+		{
+			// MarketFull
+			Type:       CommandMarket,
+			MarketBase: d(5),
+			IsBuy:      true,
+		},
+	}
+	testMatchConfig(t, cfg, cmds)
+}
+
+func TestValidate(t *testing.T) {
+	cfg := markets.Config{
+		PriceTick:    decimal.New(5, -1),
+		VolumeStep:   decimal.New(1, -1),
+		MinVolume:    decimal.New(1, -1),
+		MaxVolume:    d(10),
+		MinNotional:  d(1),
+		BaseScale:    2,
+		CounterScale: 2,
+	}
+
+	tests := []struct {
+		Name string
+		Cmd  Command
+		Err  error
+	}{
+		{
+			Name: "limit",
+			Cmd:  Command{Type: CommandLimit, LimitPrice: d(10), LimitVolume: d(1)},
+		},
+		{
+			Name: "price tick",
+			Cmd:  Command{Type: CommandLimit, LimitPrice: decimal.New(102, -1), LimitVolume: d(1)},
+			Err:  markets.ErrPriceTick,
+		},
+		{
+			Name: "volume step",
+			Cmd:  Command{Type: CommandLimit, LimitPrice: d(10), LimitVolume: decimal.New(15, -2)},
+			Err:  markets.ErrVolumeStep,
+		},
+		{
+			Name: "max volume",
+			Cmd:  Command{Type: CommandLimit, LimitPrice: d(10), LimitVolume: d(11)},
+			Err:  markets.ErrMaxVolume,
+		},
+		{
+			Name: "min notional",
+			Cmd:  Command{Type: CommandPostOnly, LimitPrice: d(5), LimitVolume: decimal.New(1, -1)},
+			Err:  markets.ErrMinNotional,
+		},
+		{
+			Name: "base scale",
+			Cmd:  Command{Type: CommandMarket, MarketBase: decimal.New(1001, -3)},
+			Err:  markets.ErrAmountScale,
+		},
+		{
+			Name: "iceberg display step",
+			Cmd: Command{Type: CommandLimit, LimitPrice: d(5), LimitVolume: d(1),
+				LimitDisplay: decimal.New(5, -2)},
+			Err: markets.ErrVolumeStep,
+		},
+		{
+			Name: "stop price tick",
+			Cmd: Command{Type: CommandStopLimit, StopPrice: decimal.New(101, -1),
+				LimitPrice: d(10), LimitVolume: d(1)},
+			Err: markets.ErrPriceTick,
+		},
+		{
+			Name: "amend",
+			Cmd: Command{Type: CommandAmend, LimitPrice: d(10), LimitVolume: d(2),
+				VolumeDelta: d(1)},
+		},
+		{
+			Name: "amend price tick",
+			Cmd: Command{Type: CommandAmend, LimitPrice: decimal.New(102, -1),
+				LimitVolume: d(1)},
+			Err: markets.ErrPriceTick,
+		},
+		{
+			Name: "amend volume step",
+			Cmd: Command{Type: CommandAmend, LimitPrice: d(10),
+				LimitVolume: decimal.New(15, -2), VolumeDelta: decimal.New(-85, -2)},
+			Err: markets.ErrVolumeStep,
+		},
+		{
+			Name: "amend without volume",
+			Cmd:  Command{Type: CommandAmend, LimitPrice: d(10), VolumeDelta: d(-1)},
+			Err:  markets.ErrInvalidVolume,
+		},
+		{
+			Name: "cancel",
+			Cmd:  Command{Type: CommandCancel},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			jtest.Require(t, test.Err, validate(test.Cmd, cfg))
+		})
+	}
+}
+
+func TestPostOnlySlide(t *testing.T) {
+	cfg := markets.Config{
+		PriceTick:    decimal.New(5, -1),
+		BaseScale:    8,
+		CounterScale: 8,
+	}
+
+	cmds := []Command{{ /* CommandOld*/ },
+		{
+			// LimitMaker Ask:1@10
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+		},
+		{
+			// LimitMaker Bid:1@8
+			Type:        CommandLimit,
+			LimitPrice:  d(8),
+			LimitVolume: d(1),
+			IsBuy:       true,
+		},
+		{
+			// PostFailed Bid:1@11
+			Type:        CommandPostOnly,
+			LimitPrice:  d(11),
+			LimitVolume: d(1),
+			IsBuy:       true,
+		},
+		{
+			// PostSlid Bid:1@11 -> 9.5
+			Type:        CommandPostOnly,
+			LimitPrice:  d(11),
+			LimitVolume: d(1),
+			IsBuy:       true,
+			Slide:       true,
+		},
+		{
+			// PostSlid Ask:2@7 -> 10
+			Type:        CommandPostOnly,
+			LimitPrice:  d(7),
+			LimitVolume: d(2),
+			Slide:       true,
+		},
+		{
+			// Posted Ask:1@12 (not crossing)
+			Type:        CommandPostOnly,
+			LimitPrice:  d(12),
+			LimitVolume: d(1),
+			Slide:       true,
+		},
+		{
+			// MarketFull: Clear bids
+			Type:          CommandMarket,
+			MarketCounter: d(2),
+		},
+		{
+			// LimitMaker Ask:1@0.5
+			Type:        CommandLimit,
+			LimitPrice:  decimal.New(5, -1),
+			LimitVolume: d(1),
+		},
+		{
+			// PostFailed Bid:1@1 (slide price not positive)
+			Type:        CommandPostOnly,
+			LimitPrice:  d(1),
+			LimitVolume: d(1),
+			IsBuy:       true,
+			Slide:       true,
+		},
+	}
+	testMatchConfig(t, cfg, cmds)
+}
+
+func TestProRata(t *testing.T) {
+	cfg := markets.Config{
+		BaseScale:    2,
+		CounterScale: 2,
+		Allocation:   markets.AllocationProRata,
+	}
+
+	cmds := []Command{{ /* CommandOld*/ },
+		{
+			// LimitMaker Ask:1@10
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+		},
+		{
+			// LimitMaker Ask:2@10
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(2),
+		},
+		{
+			// LimitMaker Ask:7@10
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(7),
+		},
+		{
+			// LimitTaker Bid:5@10 (0.5, 1, 3.5)
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(5),
+			IsBuy:       true,
+		},
+		{
+			// LimitTaker Bid:0.1@10 (0.01, 0.02, 0.07)
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: decimal.New(1, -1),
+			IsBuy:       true,
+		},
+		{
+			// LimitTaker Bid:0.05@10 (rounded down 0, 0.01, 0.03; remainder 0.01 to first)
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: decimal.New(5, -2),
+			IsBuy:       true,
+		},
+		{
+			// LimitMaker Ask:4@11 (iceberg 1)
+			Type:         CommandLimit,
+			LimitPrice:   d(11),
+			LimitVolume:  d(4),
+			LimitDisplay: d(1),
+		},
+		{
+			// LimitMaker Ask:1@11
+			Type:        CommandLimit,
+			LimitPrice:  d(11),
+			LimitVolume: d(1),
+		},
+		{
+			// MarketFull Bid:base 100 (sweeps 10 level and replenishes 11 level)
+			Type:       CommandMarket,
+			MarketBase: d(100),
+			IsBuy:      true,
+		},
+	}
+	testMatchConfig(t, cfg, cmds)
+}
+
+func TestProRataTopPriority(t *testing.T) {
+	cfg := markets.Config{
+		BaseScale:     2,
+		CounterScale:  2,
+		Allocation:    markets.AllocationProRata,
+		TopPriority:   true,
+		MinAllocation: decimal.New(6, -1),
+	}
+
+	cmds := []Command{{ /* CommandOld*/ },
+		{
+			// LimitMaker Ask:1@10
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+		},
+		{
+			// LimitMaker Ask:2@10
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(2),
+		},
+		{
+			// LimitMaker Ask:6@10
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(6),
+		},
+		{
+			// LimitTaker Bid:3@10 (top 1, then 0.5 below minimum, 1.5; remainder 0.5 to second)
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(3),
+			IsBuy:       true,
+		},
+		{
+			// LimitTaker Bid:1@10 (top 1.5 partial filled)
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+			IsBuy:       true,
+		},
+		{
+			// LimitPartial Bid:6@10 (fills level)
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(6),
+			IsBuy:       true,
+		},
+	}
+	testMatchConfig(t, cfg, cmds)
+}
+
+func TestAuction(t *testing.T) {
+	cmds := []Command{{ /* CommandOld*/ },
+		{
+			// LimitMaker Ask:1@10
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+		},
+		{
+			// AuctionStarted
+			Type: CommandAuctionStart,
+		},
+		{
+			// Posted Bid:2@11 (crossing)
+			Type:        CommandLimit,
+			LimitPrice:  d(11),
+			LimitVolume: d(2),
+			IsBuy:       true,
+		},
+		{
+			// Posted Ask:3@12
+			Type:        CommandLimit,
+			LimitPrice:  d(12),
+			LimitVolume: d(3),
+		},
+		{
+			// Posted Bid:2@12 (crossing)
+			Type:        CommandLimit,
+			LimitPrice:  d(12),
+			LimitVolume: d(2),
+			IsBuy:       true,
+		},
+		{
+			// Rejected: Market
+			Type:       CommandMarket,
+			MarketBase: d(10),
+			IsBuy:      true,
+		},
+		{
+			// Rejected: IOC
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+			TimeInForce: TimeInForceIOC,
+		},
+		{
+			// AuctionFailed: Already in auction
+			Type: CommandAuctionStart,
+		},
+		{
+			// Posted Ask:1@11 (crossing)
+			Type:        CommandLimit,
+			LimitPrice:  d(11),
+			LimitVolume: d(1),
+		},
+		{
+			// Uncrossed @11 (volume 2, surplus 2)
+			Type: CommandUncross,
+		},
+		{
+			// AuctionFailed: Not in auction
+			Type: CommandUncross,
+		},
+		{
+			// LimitTaker Bid:1@12 (continuous)
+			Type:        CommandLimit,
+			LimitPrice:  d(12),
+			LimitVolume: d(1),
+			IsBuy:       true,
+		},
+	}
+	testMatch(t, cmds)
+}
+
+func TestAuctionSelfTrade(t *testing.T) {
+	cmds := []Command{{ /* CommandOld*/ },
+		{
+			// AuctionStarted
+			Type: CommandAuctionStart,
+		},
+		{
+			// Posted Ask:1@10 (A)
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+			AccountID:   1,
+		},
+		{
+			// Posted Ask:1@10 (B)
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+			AccountID:   2,
+		},
+		{
+			// Posted Bid:2@10 (A)
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(2),
+			IsBuy:       true,
+			AccountID:   1,
+		},
+		{
+			// Posted Bid:1@10 (C)
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+			IsBuy:       true,
+			AccountID:   3,
+		},
+		{
+			// Uncrossed @10: Cancel newest (bid A), C trades with ask A
+			Type: CommandUncross,
+		},
+		{
+			// AuctionStarted
+			Type: CommandAuctionStart,
+		},
+		{
+			// Posted Bid:1@10 (B)
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+			IsBuy:       true,
+			AccountID:   2,
+			STP:         STPCancelOldest,
+		},
+		{
+			// Posted Ask:1@10 (D)
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+			AccountID:   4,
+		},
+		{
+			// Uncrossed @10: Cancel oldest (ask B), bid B trades with D
+			Type: CommandUncross,
+		},
+		{
+			// AuctionStarted
+			Type: CommandAuctionStart,
+		},
+		{
+			// Posted Ask:2@10 (E)
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(2),
+			AccountID:   5,
+		},
+		{
+			// Posted Bid:3@10 (E)
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(3),
+			IsBuy:       true,
+			AccountID:   5,
+			STP:         STPDecrement,
+		},
+		{
+			// Posted Ask:1@10 (F)
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+			AccountID:   6,
+		},
+		{
+			// Uncrossed @10: Decrement (ask E cancelled), bid E trades 1 with F
+			Type: CommandUncross,
+		},
+		{
+			// AuctionStarted
+			Type: CommandAuctionStart,
+		},
+		{
+			// Posted Ask:1@10 (G)
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+			AccountID:   7,
+		},
+		{
+			// Posted Bid:1@10 (G)
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+			IsBuy:       true,
+			AccountID:   7,
+			STP:         STPCancelBoth,
+		},
+		{
+			// Uncrossed @10: Cancel both, no trades
+			Type: CommandUncross,
+		},
+	}
+	testMatch(t, cmds)
+}
+
+func TestHalt(t *testing.T) {
+	cmds := []Command{{ /* CommandOld*/ },
+		{
+			// LimitMaker Ask:1@10
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+		},
+		{
+			// LimitMaker Bid:1@8
+			Type:        CommandLimit,
+			LimitPrice:  d(8),
+			LimitVolume: d(1),
+			IsBuy:       true,
+		},
+		{
+			// Halted
+			Type: CommandHalt,
+		},
+		{
+			// Rejected: Halted
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+			IsBuy:       true,
+		},
+		{
+			// Cancelled Bid:1@8
+			Type:    CommandCancel,
+			OrderID: 2,
+			IsBuy:   true,
+		},
+		{
+			// AmendFailed: Halted
+			Type:        CommandAmend,
+			OrderID:     1,
+			LimitPrice:  d(9),
+			LimitVolume: d(1),
+			VolumeDelta: d(0),
+		},
+		{
+			// AuctionFailed: Halted
+			Type: CommandUncross,
+		},
+		{
+			// HaltFailed: Already halted
+			Type: CommandHalt,
+		},
+		{
+			// Resumed
+			Type: CommandResume,
+		},
+		{
+			// HaltFailed: Not halted
+			Type: CommandResume,
+		},
+		{
+			// Halted
+			Type: CommandHalt,
+		},
+		{
+			// AuctionStarted: Re-open via auction
+			Type: CommandAuctionStart,
+		},
+		{
+			// Posted Bid:1@11 (crossing)
+			Type:        CommandLimit,
+			LimitPrice:  d(11),
+			LimitVolume: d(1),
+			IsBuy:       true,
+		},
+		{
+			// Uncrossed @10
+			Type: CommandUncross,
+		},
+	}
+	testMatch(t, cmds)
+}
+
+func TestMassCancel(t *testing.T) {
+	cmds := []Command{{ /* CommandOld*/ },
+		{
+			// LimitMaker Ask:1@10 Account:1
+			Type:        CommandLimit,
+			LimitPrice:  d(10),
+			LimitVolume: d(1),
+			AccountID:   1,
+		},
+		{
+			// LimitMaker Ask:1@12 Account:2
+			Type:        CommandLimit,
+			LimitPrice:  d(12),
+			LimitVolume: d(1),
+			AccountID:   2,
+		},
+		{
+			// LimitMaker Bid:1@8 Account:1
+			Type:        CommandLimit,
+			LimitPrice:  d(8),
+			LimitVolume: d(1),
+			IsBuy:       true,
+			AccountID:   1,
+		},
+		{
+			// LimitMaker Bid:1@7 Account:2
+			Type:        CommandLimit,
+			LimitPrice:  d(7),
+			LimitVolume: d(1),
+			IsBuy:       true,
+			AccountID:   2,
+		},
+		{
+			// StopAccepted Sell@6 Account:1
+			Type:          CommandStop,
+			StopPrice:     d(6),
+			MarketCounter: d(1),
+			AccountID:     1,
+		},
+		{
+			// MassCancelled: Account 1 bids
+			Type:   CommandMassCancel,
+			Filter: &CancelFilter{AccountID: 1, Side: SideBid},
+		},
+		{
+			// MassCancelled: Price range 6-10; Bid:1@7, Ask:1@10 and stop
+			Type:   CommandMassCancel,
+			Filter: &CancelFilter{MinPrice: d(6), MaxPrice: d(10)},
+		},
+		{
+			// MassCancelled: Nothing selected
+			Type:   CommandMassCancel,
+			Filter: &CancelFilter{AccountID: 3},
+		},
+		{
+			// MassCancelled: Everything
+			Type: CommandMassCancel,
+		},
+	}
+	testMatch(t, cmds)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	cfg := markets.Config{
+		BaseScale:     8,
+		CounterScale:  8,
+		BreakerPct:    d(10),
+		BreakerWindow: time.Minute,
+	}
+
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	cmds := []Command{{ /* CommandOld*/ },
+		{
+			// LimitMaker Ask:1@100
+			Type:        CommandLimit,
+			LimitPrice:  d(100),
+			LimitVolume: d(1),
+		},
+		{
+			// LimitMaker Ask:1@105
+			Type:        CommandLimit,
+			LimitPrice:  d(105),
+			LimitVolume: d(1),
+		},
+		{
+			// LimitMaker Ask:1@115
+			Type:        CommandLimit,
+			LimitPrice:  d(115),
+			LimitVolume: d(1),
+		},
+		{
+			// LimitMaker Ask:1@130
+			Type:        CommandLimit,
+			LimitPrice:  d(130),
+			LimitVolume: d(1),
+		},
+		{
+			// LimitTaker Bid:1@100 (reference 100)
+			Type:        CommandLimit,
+			LimitPrice:  d(100),
+			LimitVolume: d(1),
+			IsBuy:       true,
+			Timestamp:   t0,
+		},
+		{
+			// LimitTaker Bid:1@105 (5%)
+			Type:        CommandLimit,
+			LimitPrice:  d(105),
+			LimitVolume: d(1),
+			IsBuy:       true,
+			Timestamp:   t0.Add(30 * time.Second),
+		},
+		{
+			// LimitTaker Bid:1@115 (window expired, reference 115)
+			Type:        CommandLimit,
+			LimitPrice:  d(115),
+			LimitVolume: d(1),
+			IsBuy:       true,
+			Timestamp:   t0.Add(2 * time.Minute),
+		},
+		{
+			// LimitTaker Bid:1@130 (13%, circuit breaker)
+			Type:        CommandLimit,
+			LimitPrice:  d(130),
+			LimitVolume: d(1),
+			IsBuy:       true,
+			Timestamp:   t0.Add(150 * time.Second),
+		},
+		{
+			// Rejected: Halted
+			Type:        CommandLimit,
+			LimitPrice:  d(130),
+			LimitVolume: d(1),
+		},
+		{
+			// Resumed
+			Type: CommandResume,
+		},
+		{
+			// LimitMaker Ask:1@130
+			Type:        CommandLimit,
+			LimitPrice:  d(130),
+			LimitVolume: d(1),
+			Timestamp:   t0.Add(3 * time.Minute),
+		},
+	}
+	testMatchConfig(t, cfg, cmds)
+}
+
+func TestFees(t *testing.T) {
+	cfg := markets.Config{
+		BaseScale:    2,
+		CounterScale: 2,
+		MakerFeeBps:  d(-1),
+		TakerFeeBps:  d(5),
+		FeeTiers: []markets.FeeTier{{
+			Accounts:    []int64{7, 8},
+			MakerFeeBps: decimal.Zero,
+			TakerFeeBps: d(2),
+		}},
+	}
+
+	cmds := []Command{{ /* CommandOld*/ },
+		{
+			// LimitMaker Ask:1.5@100.5
+			Type:        CommandLimit,
+			LimitPrice:  decimal.New(1005, -1),
+			LimitVolume: decimal.New(15, -1),
+			AccountID:   1,
+		},
+		{
+			// LimitMaker Ask:1@101 (tier)
+			Type:        CommandLimit,
+			LimitPrice:  d(101),
+			LimitVolume: d(1),
+			AccountID:   7,
+		},
+		{
+			// LimitTaker Bid:2@101 (taker 5bps, maker -1bps and 0bps)
+			Type:        CommandLimit,
+			LimitPrice:  d(101),
+			LimitVolume: d(2),
+			IsBuy:       true,
+			AccountID:   2,
+		},
+		{
+			// LimitTaker Bid:0.5@101 (tier taker 2bps, maker 0bps)
+			Type:        CommandLimit,
+			LimitPrice:  d(101),
+			LimitVolume: decimal.New(5, -1),
+			IsBuy:       true,
+			AccountID:   8,
+		},
+	}
+	testMatchConfig(t, cfg, cmds)
+}
+
+func TestMarketAmounts(t *testing.T) {
+	cfg := markets.Config{
+		BaseScale:    2,
+		CounterScale: 2,
+	}
+
+	cmds := []Command{{ /* CommandOld*/ },
+		{
+			// LimitMaker Ask:1@3
+			Type:        CommandLimit,
+			LimitPrice:  d(3),
+			LimitVolume: d(1),
+		},
+		{
+			// LimitMaker Ask:1@7
+			Type:        CommandLimit,
+			LimitPrice:  d(7),
+			LimitVolume: d(1),
+		},
+		{
+			// MarketFull: Buy counter 1.5
+			Type:          CommandMarket,
+			MarketCounter: decimal.New(15, -1),
+			IsBuy:         true,
+		},
+		{
+			// LimitMaker Bid:2@3
+			Type:        CommandLimit,
+			LimitPrice:  d(3),
+			LimitVolume: d(2),
+			IsBuy:       true,
+		},
+		{
+			// LimitMaker Bid:1@2
+			Type:        CommandLimit,
+			LimitPrice:  d(2),
+			LimitVolume: d(1),
+			IsBuy:       true,
+		},
+		{
+			// MarketFull: Sell base 7 (2@3 and 0.5@2)
+			Type:       CommandMarket,
+			MarketBase: d(7),
+		},
+		{
+			// LimitMaker Ask:1@3
+			Type:        CommandLimit,
+			LimitPrice:  d(3),
+			LimitVolume: d(1),
+		},
+		{
+			// MarketFull: Buy base 2 (0.66@3 rounded down, not overspending)
+			Type:       CommandMarket,
+			MarketBase: d(2),
+			IsBuy:      true,
+		},
+		{
+			// MarketFull: Buy base 0.01 (dust, no trades)
+			Type:       CommandMarket,
+			MarketBase: decimal.New(1, -2),
+			IsBuy:      true,
+		},
+		{
+			// Rejected: Both base and counter
+			Type:          CommandMarket,
+			MarketBase:    d(1),
+			MarketCounter: d(1),
+			IsBuy:         true,
+		},
+		{
+			// LimitMaker Bid:2@2.5
+			Type:        CommandLimit,
+			LimitPrice:  decimal.New(25, -1),
+			LimitVolume: d(2),
+			IsBuy:       true,
+		},
+		{
+			// LimitMaker Bid:1@0.5
+			Type:        CommandLimit,
+			LimitPrice:  decimal.New(5, -1),
+			LimitVolume: d(1),
+			IsBuy:       true,
+		},
+		{
+			// MarketFull: Sell base 2.53 (1.01@2.5, 0.005 base dust left
+			// untraded instead of trading at worse prices)
+			Type:       CommandMarket,
+			MarketBase: decimal.New(253, -2),
+		},
+		{
+			// MarketFull: Sell base 0.02 (dust at the best price, no trades)
+			Type:       CommandMarket,
+			MarketBase: decimal.New(2, -2),
+		},
+	}
+	testMatchConfig(t, cfg, cmds)
+}
+
+func TestIndicative(t *testing.T) {
+	var book OrderBook
+	MatchCommand(&book, Command{Type: CommandLimit, OrderID: 1, IsBuy: true,
+		LimitPrice: d(10), LimitVolume: d(3)}, markets.Default)
+
+	price, volume := book.Indicative()
+	require.True(t, price.IsZero())
+	require.True(t, volume.IsZero())
+
+	MatchCommand(&book, Command{Type: CommandAuctionStart}, markets.Default)
+	MatchCommand(&book, Command{Type: CommandLimit, OrderID: 2,
+		LimitPrice: d(9), LimitVolume: d(1), LimitDisplay: decimal.New(5, -1)}, markets.Default)
+	MatchCommand(&book, Command{Type: CommandLimit, OrderID: 3,
+		LimitPrice: d(10), LimitVolume: d(4)}, markets.Default)
+
+	require.Equal(t, StateAuction, book.State())
+
+	price, volume = book.Indicative()
+	require.Equal(t, "10", price.String())
+	require.Equal(t, "3", volume.String())
+
+	// Auction state survives snapshots.
+	b, err := json.Marshal(book)
+	jtest.Require(t, nil, err)
+	var clone OrderBook
+	jtest.Require(t, nil, json.Unmarshal(b, &clone))
+	require.Equal(t, StateAuction, clone.State())
+
+	r, err := MatchCommand(&book, Command{Type: CommandUncross}, markets.Default)
+	jtest.Require(t, nil, err)
+	require.Equal(t, TypeUncrossed, r.Type)
+	require.Equal(t, StateContinuous, book.State())
+	require.Len(t, r.Trades, 2)
+	require.False(t, r.Trades[0].MakerFilled)
+	require.True(t, r.Trades[0].TakerFilled) // Iceberg ask
+	require.True(t, r.Trades[1].MakerFilled)
+	require.False(t, r.Trades[1].TakerFilled)
+
+	bids, asks := book.Depth(1)
+	require.Empty(t, bids)
+	require.Equal(t, "2", asks[0].Volume.String())
+}
+
+func TestHash(t *testing.T) {
+	cmds := []Command{
+		{Sequence: 1, Type: CommandLimit, OrderID: 1, LimitPrice: d(10), LimitVolume: d(3)},
+		{Sequence: 2, Type: CommandUnknown},
+		{Sequence: 3, Type: CommandLimit, OrderID: 2, IsBuy: true, LimitPrice: d(10), LimitVolume: d(1)},
+		{Sequence: 4, Type: CommandCancel, OrderID: 1},
+	}
+
+	var (
+		book  OrderBook
+		prev  string
+		first string
+	)
+	for i, cmd := range cmds {
+		r, err := MatchCommand(&book, cmd, markets.Default)
+		jtest.Require(t, nil, err)
+		if cmd.Type == CommandUnknown {
+			require.Empty(t, r.Hash)
+			continue
+		}
+		hash, err := NextHash(prev, cmd, r)
+		jtest.Require(t, nil, err)
+		require.Equal(t, hash, r.Hash)
+		require.Equal(t, r.Hash, book.Hash())
+		prev = r.Hash
+
+		if i == 0 {
+			first = r.Hash
+
+			// The hash survives snapshots.
+			b, err := json.Marshal(book)
+			jtest.Require(t, nil, err)
+			var clone OrderBook
+			jtest.Require(t, nil, json.Unmarshal(b, &clone))
+			require.Equal(t, book.Hash(), clone.Hash())
+		}
+	}
+
+	// A different command diverges the hash.
+	var other OrderBook
+	cmd := cmds[0]
+	cmd.LimitVolume = d(2)
+	r, err := MatchCommand(&other, cmd, markets.Default)
+	jtest.Require(t, nil, err)
+	require.NotEqual(t, first, r.Hash)
+}
+
+func TestErrorPolicy(t *testing.T) {
+	cmds := []Command{
+		{Sequence: 1, Type: CommandLimit, OrderID: 1, LimitPrice: d(10), LimitVolume: d(1)},
+		{Sequence: 2, Type: CommandType(99), OrderID: 2},
+		{Sequence: 3, Type: CommandCancel, OrderID: 1},
+	}
+
+	var book OrderBook
+	_, err := MatchCommand(&book, cmds[0], markets.Default)
+	jtest.Require(t, nil, err)
+
+	r, err := MatchCommand(&book, cmds[1], markets.Default)
+	jtest.Require(t, ErrUnknownCommand, err)
+	require.Equal(t, TypeFailed, r.Type)
+	require.NotEmpty(t, r.Hash)
+
+	r, err = MatchCommand(&book, Command{Sequence: 3, Type: CommandInvalid,
+		OrderID: 3}, markets.Default)
+	jtest.Require(t, ErrInvalidCommand, err)
+	require.Equal(t, TypeFailed, r.Type)
+
+	// Stop by default.
+	input := make(chan Command, len(cmds))
+	output := make(chan Result, len(cmds))
+	for _, cmd := range cmds {
+		input <- cmd
+	}
+	err = Match(context.Background(), OrderBook{}, input, output,
+		markets.Default, func(*OrderBook) {}, func() func() { return func() {} })
+	jtest.Require(t, ErrUnknownCommand, err)
+	require.Len(t, output, 1)
+
+	// Reject and continue.
+	cfg := markets.Default
+	cfg.ErrorPolicy = markets.ErrorPolicyReject
+	input = make(chan Command, len(cmds))
+	output = make(chan Result, len(cmds))
+	for _, cmd := range cmds {
+		input <- cmd
+	}
+	ctx := &ctx{count: len(cmds)}
+	err = Match(ctx, OrderBook{}, input, output,
+		cfg, func(*OrderBook) {}, func() func() { return func() {} })
+	jtest.Require(t, ctxDone, err)
+	require.Len(t, output, 3)
+	require.Equal(t, TypeLimitMaker, (<-output).Type)
+	require.Equal(t, TypeFailed, (<-output).Type)
+	require.Equal(t, TypeCancelled, (<-output).Type)
+}
+
+func TestDepth(t *testing.T) {
+	var book OrderBook
+	MatchCommand(&book, Command{Type: CommandLimit, OrderID: 1, IsBuy: true,
+		LimitPrice: d(9), LimitVolume: d(5), LimitDisplay: d(1)}, markets.Default)
+	MatchCommand(&book, Command{Type: CommandLimit, OrderID: 2, IsBuy: true,
+		LimitPrice: d(9), LimitVolume: d(2)}, markets.Default)
+	MatchCommand(&book, Command{Type: CommandLimit, OrderID: 3, IsBuy: true,
+		LimitPrice: d(8), LimitVolume: d(1)}, markets.Default)
+
+	bids, asks := book.Depth(1)
+	require.Empty(t, asks)
+	require.Len(t, bids, 1)
+	require.Equal(t, "9", bids[0].Price.String())
+	require.Equal(t, "3", bids[0].Volume.String())
+	require.Equal(t, 2, bids[0].Count)
+}
+
+func TestSnapshot(t *testing.T) {
+	var book OrderBook
+	for _, cmd := range []Command{
+		{Sequence: 1, Type: CommandLimit, OrderID: 1, IsBuy: true, LimitPrice: d(9), LimitVolume: d(2)},
+		{Sequence: 2, Type: CommandLimit, OrderID: 2, LimitPrice: d(11), LimitVolume: d(1)},
+		{Sequence: 3, Type: CommandStop, OrderID: 3, StopPrice: d(8), MarketBase: d(1)},
+	} {
+		_, err := MatchCommand(&book, cmd, markets.Default)
+		jtest.Require(t, nil, err)
+		book.Sequence = cmd.Sequence
+	}
+
+	expect, err := json.Marshal(book)
+	jtest.Require(t, nil, err)
+
+	snap := book.Snapshot()
+	require.Equal(t, int64(3), snap.Sequence())
+
+	// Later commands don't affect the snapshot.
+	_, err = MatchCommand(&book, Command{Sequence: 4, Type: CommandCancel,
+		OrderID: 1, IsBuy: true}, markets.Default)
+	jtest.Require(t, nil, err)
+
+	b, err := json.Marshal(snap)
+	jtest.Require(t, nil, err)
+	require.JSONEq(t, string(expect), string(b))
+
+	clone := snap.Book()
+	b, err = json.Marshal(clone)
+	jtest.Require(t, nil, err)
+	require.JSONEq(t, string(expect), string(b))
+}
+
 func testMatch(t *testing.T, cmds []Command) {
+	testMatchConfig(t, markets.Default, cmds)
+}
+
+func testMatchConfig(t *testing.T, cfg markets.Config, cmds []Command) {
 
 	count := len(cmds)
 	ctx := &ctx{count: count}
@@ -351,8 +1992,11 @@ func testMatch(t *testing.T, cmds []Command) {
 	for i, cmd := range cmds {
 		cmd.Sequence = int64(i)
 
-		// Auto fill non-cancel order ids.
-		if cmd.Type != CommandCancel {
+		// Auto fill order ids of new orders.
+		switch cmd.Type {
+		case CommandCancel, CommandExpire, CommandAmend, CommandAuctionStart,
+			CommandUncross, CommandHalt, CommandResume, CommandMassCancel:
+		default:
 			cmd.OrderID = int64(i)
 		}
 		input <- cmd
@@ -364,15 +2008,24 @@ func testMatch(t *testing.T, cmds []Command) {
 		books[book.Sequence] = printBook(book)
 	}
 
-	err := Match(ctx, OrderBook{}, input, output, 8, snap, latency)
+	err := Match(ctx, OrderBook{}, input, output, cfg, snap, latency)
 	jtest.Require(t, ctxDone, err)
 	require.Len(t, output, count)
 
+	type triggered struct {
+		OrderID int64
+		Type    string
+		Trades  []Trade
+	}
 	type r struct {
-		Seq    int64
-		Type   string
-		Trades []Trade
-		Book   string
+		Seq       int64
+		Type      string
+		Trades    []Trade
+		Price     string      `yaml:",omitempty"`
+		Reason    string      `yaml:",omitempty"`
+		Cancelled []int64     `yaml:",omitempty"`
+		Triggered []triggered `yaml:",omitempty"`
+		Book      string
 	}
 	var rl []r
 	close(output)
@@ -380,11 +2033,31 @@ func testMatch(t *testing.T, cmds []Command) {
 		o := <-output
 		seq := o.Sequence
 		require.Equal(t, int64(i), seq)
+		var tl []triggered
+		for _, tr := range o.Triggered {
+			tl = append(tl, triggered{
+				OrderID: tr.OrderID,
+				Type:    tr.Type.String(),
+				Trades:  tr.Trades,
+			})
+		}
+		var reason string
+		if o.Reason != ReasonUnknown {
+			reason = o.Reason.String()
+		}
+		var price string
+		if !o.Price.IsZero() {
+			price = o.Price.String()
+		}
 		rl = append(rl, r{
-			Seq:    seq,
-			Type:   o.Type.String(),
-			Trades: o.Trades,
-			Book:   books[seq] + "\n\n",
+			Seq:       seq,
+			Type:      o.Type.String(),
+			Trades:    o.Trades,
+			Price:     price,
+			Reason:    reason,
+			Cancelled: o.Cancelled,
+			Triggered: tl,
+			Book:      books[seq] + "\n\n",
 		})
 	}
 
@@ -419,10 +2092,10 @@ func (c *ctx) Err() error {
 func printBook(book *OrderBook) string {
 	var sb strings.Builder
 
-	asks := reserve(printSide(book.Asks))
+	asks := reserve(printSide(book.Asks()))
 	sb.WriteString(strings.Join(asks, "\n"))
 	sb.WriteString("\n-------\n")
-	bids := printSide(book.Bids)
+	bids := printSide(book.Bids())
 	sb.WriteString(strings.Join(bids, "\n"))
 	sb.WriteString("\n")
 
@@ -441,13 +2114,17 @@ func printSide(side []Order) []string {
 	var res []string
 	var line string
 	for _, o := range side {
+		vol := o.Remaining.String()
+		if o.Hidden.Sign() > 0 {
+			vol += fmt.Sprintf("(+%s)", o.Hidden)
+		}
 		if strings.Contains(line, o.Price.String()) {
-			line += ", " + o.Remaining.String()
+			line += ", " + vol
 		} else {
 			if line != "" {
 				res = append(res, line)
 			}
-			line = fmt.Sprintf("%s: %s", o.Price, o.Remaining)
+			line = fmt.Sprintf("%s: %s", o.Price, vol)
 		}
 	}
 
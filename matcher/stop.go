@@ -0,0 +1,92 @@
+package matcher
+
+import "github.com/corverroos/exchange/markets"
+
+// triggerStops applies the stop orders triggered by the trades and
+// returns their results. Triggered stops are converted to market or limit
+// orders and applied in the order they were accepted. Their trades may
+// in turn trigger more stops. It returns the results up to and including
+// the failed result on error.
+func triggerStops(book *OrderBook, seq int64, tl []Trade, cfg markets.Config) ([]Result, error) {
+	var res []Result
+	for len(tl) > 0 {
+		triggered := popTriggered(book, tl)
+		tl = nil
+
+		for _, stop := range triggered {
+			cmd := stop
+			cmd.Sequence = seq
+			if stop.Type == CommandStop {
+				cmd.Type = CommandMarket
+			} else {
+				cmd.Type = CommandLimit
+			}
+
+			r, err := matchCommand(book, cmd, cfg)
+
+			res = append(res, Result{
+				Sequence: seq,
+				OrderID:  stop.OrderID,
+				Type:     TypeStopTriggered,
+			}, r)
+
+			if err != nil {
+				return res, err
+			}
+
+			tl = append(tl, r.Trades...)
+		}
+	}
+
+	return res, nil
+}
+
+// popTriggered removes and returns the stop orders triggered by the trades.
+// Buy stops trigger when a trade price is at or above the stop price.
+// Sell stops trigger when a trade price is at or below the stop price.
+func popTriggered(book *OrderBook, tl []Trade) []Command {
+	if len(book.stops) == 0 {
+		return nil
+	}
+
+	high, low := tl[0].Price, tl[0].Price
+	for _, t := range tl[1:] {
+		if t.Price.GreaterThan(high) {
+			high = t.Price
+		}
+		if t.Price.LessThan(low) {
+			low = t.Price
+		}
+	}
+
+	var (
+		triggered []Command
+		dormant   []Command
+	)
+	for _, stop := range book.stops {
+		if stop.IsBuy && high.GreaterThanOrEqual(stop.StopPrice) ||
+			!stop.IsBuy && low.LessThanOrEqual(stop.StopPrice) {
+			triggered = append(triggered, stop)
+		} else {
+			dormant = append(dormant, stop)
+		}
+	}
+
+	book.stops = dormant
+
+	return triggered
+}
+
+// cancelStop returns true if the stop order was removed from the book.
+func cancelStop(book *OrderBook, cmd Command) bool {
+	for i, stop := range book.stops {
+		if stop.OrderID != cmd.OrderID || stop.IsBuy != cmd.IsBuy {
+			continue
+		}
+
+		book.stops = append(book.stops[:i:i], book.stops[i+1:]...)
+		return true
+	}
+
+	return false
+}
@@ -21,11 +21,31 @@ func _() {
 	_ = x[TypeLimitTaker-10]
 	_ = x[TypeLimitPartial-11]
 	_ = x[TypeLimitMaker-12]
+	_ = x[TypeStopAccepted-13]
+	_ = x[TypeStopTriggered-14]
+	_ = x[TypeIOCCancelled-15]
+	_ = x[TypeFOKKilled-16]
+	_ = x[TypeExpired-17]
+	_ = x[TypeExpireFailed-18]
+	_ = x[TypeAmended-19]
+	_ = x[TypeAmendFailed-20]
+	_ = x[TypeSelfTradeCancelled-21]
+	_ = x[TypeRejected-22]
+	_ = x[TypePostSlid-23]
+	_ = x[TypeAuctionStarted-24]
+	_ = x[TypeUncrossed-25]
+	_ = x[TypeAuctionFailed-26]
+	_ = x[TypeHalted-27]
+	_ = x[TypeResumed-28]
+	_ = x[TypeHaltFailed-29]
+	_ = x[TypeCircuitBreaker-30]
+	_ = x[TypeMassCancelled-31]
+	_ = x[TypeFailed-32]
 }
 
-const _Type_name = "UnknownCommandOldCommandUnknownCancelFailedCancelledPostFailedPostedMarketEmptyMarketPartialMarketFullLimitTakerLimitPartialLimitMaker"
+const _Type_name = "UnknownCommandOldCommandUnknownCancelFailedCancelledPostFailedPostedMarketEmptyMarketPartialMarketFullLimitTakerLimitPartialLimitMakerStopAcceptedStopTriggeredIOCCancelledFOKKilledExpiredExpireFailedAmendedAmendFailedSelfTradeCancelledRejectedPostSlidAuctionStartedUncrossedAuctionFailedHaltedResumedHaltFailedCircuitBreakerMassCancelledFailed"
 
-var _Type_index = [...]uint8{0, 7, 17, 31, 43, 52, 62, 68, 79, 92, 102, 112, 124, 134}
+var _Type_index = [...]uint16{0, 7, 17, 31, 43, 52, 62, 68, 79, 92, 102, 112, 124, 134, 146, 159, 171, 180, 187, 199, 206, 217, 235, 243, 251, 265, 274, 287, 293, 300, 310, 324, 337, 343}
 
 func (i Type) String() string {
 	if i < 0 || i >= Type(len(_Type_index)-1) {
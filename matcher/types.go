@@ -1,6 +1,9 @@
 package matcher
 
 import (
+	"encoding/json"
+	"time"
+
 	"github.com/shopspring/decimal"
 )
 
@@ -9,11 +12,38 @@ import (
 type CommandType int
 
 const (
-	CommandUnknown  CommandType = 0
-	CommandLimit    CommandType = 1
-	CommandMarket   CommandType = 2
-	CommandPostOnly CommandType = 3
-	CommandCancel   CommandType = 4
+	CommandUnknown   CommandType = 0
+	CommandLimit     CommandType = 1
+	CommandMarket    CommandType = 2
+	CommandPostOnly  CommandType = 3
+	CommandCancel    CommandType = 4
+	CommandStop      CommandType = 5
+	CommandStopLimit CommandType = 6
+	CommandExpire    CommandType = 7
+	CommandAmend     CommandType = 8
+
+	// CommandAuctionStart moves the order book into auction state.
+	CommandAuctionStart CommandType = 9
+
+	// CommandUncross executes the auction at the clearing price and
+	// moves the order book back to continuous state.
+	CommandUncross CommandType = 10
+
+	// CommandHalt halts the order book; new orders are rejected while
+	// cancels are still applied.
+	CommandHalt CommandType = 11
+
+	// CommandResume resumes a halted order book.
+	CommandResume CommandType = 12
+
+	// CommandMassCancel removes all orders and dormant stop orders
+	// selected by the command's filter from the order book.
+	CommandMassCancel CommandType = 13
+
+	// CommandInvalid is an order event that couldn't be converted to a
+	// command. It fails with ErrInvalidCommand, so the market's error
+	// policy applies.
+	CommandInvalid CommandType = 14
 )
 
 type Command struct {
@@ -22,18 +52,142 @@ type Command struct {
 	IsBuy    bool
 	OrderID  int64
 
-	LimitPrice  decimal.Decimal
-	LimitVolume decimal.Decimal
+	// Timestamp is the time of the order event. It is used by the circuit
+	// breaker instead of wall time to keep matching deterministic.
+	Timestamp time.Time
+
+	// Market identifies the order book of the command.
+	// It is used for routing and ignored by the matcher.
+	Market string `json:",omitempty"`
+
+	LimitPrice  decimal.Decimal // Also the new price of amend commands.
+	LimitVolume decimal.Decimal // Also the new volume of amend commands.
 
 	MarketBase    decimal.Decimal // Eg. when buying BTC with X USD
 	MarketCounter decimal.Decimal // Eg. when selling X BTC for USD
+
+	// Market orders stop trading at the worst price and/or the max slippage
+	// percent relative to the best price when matched. Zero disables.
+	WorstPrice  decimal.Decimal
+	MaxSlippage decimal.Decimal
+
+	StopPrice decimal.Decimal // Trigger price of stop orders.
+
+	TimeInForce TimeInForce // Only applicable to limit orders.
+
+	// Slide reprices crossing post only orders to one tick behind the
+	// best opposite price instead of failing.
+	Slide bool `json:",omitempty"`
+
+	LimitDisplay decimal.Decimal // Visible volume of iceberg orders.
+
+	VolumeDelta decimal.Decimal // Change in volume of amend commands.
+
+	// AccountID is the owner of the order. Orders of the same account
+	// do not trade with each other, see STP. Zero disables self-trade
+	// prevention.
+	AccountID int64
+
+	STP STP // Self-trade prevention mode.
+
+	// Filter selects the orders removed by mass cancel commands.
+	Filter *CancelFilter `json:",omitempty"`
 }
 
+// Side selects bids, asks or both.
+type Side int
+
+const (
+	SideBoth Side = 0
+	SideBid  Side = 1
+	SideAsk  Side = 2
+)
+
+// CancelFilter selects the orders removed by mass cancel commands.
+// Dormant stop orders are selected by their stop price. The zero value
+// selects all orders.
+type CancelFilter struct {
+	AccountID int64           `json:",omitempty"` // Only orders of the account if non-zero.
+	Side      Side            `json:",omitempty"` // Only orders of the side.
+	MinPrice  decimal.Decimal // Only orders priced at or above if non-zero.
+	MaxPrice  decimal.Decimal // Only orders priced at or below if non-zero.
+}
+
+// Matches returns true if the order of the account, side and price
+// is selected by the filter.
+func (f CancelFilter) Matches(accountID int64, isBid bool, price decimal.Decimal) bool {
+	if f.AccountID != 0 && f.AccountID != accountID {
+		return false
+	} else if f.Side == SideBid && !isBid || f.Side == SideAsk && isBid {
+		return false
+	} else if !f.MinPrice.IsZero() && price.LessThan(f.MinPrice) {
+		return false
+	} else if !f.MaxPrice.IsZero() && price.GreaterThan(f.MaxPrice) {
+		return false
+	}
+
+	return true
+}
+
+// TimeInForce defines how long a limit order remains active.
+type TimeInForce int
+
+const (
+	// TimeInForceGTC (good-till-cancelled) orders rest in the order book.
+	TimeInForceGTC TimeInForce = 0
+
+	// TimeInForceIOC (immediate-or-cancel) orders cancel any remaining
+	// volume after trading.
+	TimeInForceIOC TimeInForce = 1
+
+	// TimeInForceFOK (fill-or-kill) orders are only applied if they
+	// can be filled completely.
+	TimeInForceFOK TimeInForce = 2
+)
+
+// STP (self-trade prevention) defines what happens when an order would
+// trade with an order of the same account. The taker's mode applies.
+type STP int
+
+const (
+	// STPCancelNewest cancels the taker order. This is the default.
+	STPCancelNewest STP = 0
+
+	// STPCancelOldest cancels the maker order and continues matching.
+	STPCancelOldest STP = 1
+
+	// STPCancelBoth cancels both the taker and the maker orders.
+	STPCancelBoth STP = 2
+
+	// STPDecrement reduces both orders by the smaller volume, cancelling
+	// the smaller order (or both if equal).
+	STPDecrement STP = 3
+)
+
+// State is the trading state of an order book.
+type State int
+
+const (
+	// StateContinuous matches orders as they arrive. This is the default.
+	StateContinuous State = 0
+
+	// StateAuction accumulates limit orders without matching until the
+	// book is uncrossed. Market, IOC and FOK orders are rejected.
+	StateAuction State = 1
+)
+
 // Order is a bid or ask order.
 type Order struct {
 	ID        int64
+	AccountID int64 `json:",omitempty"`
+	STP       STP   `json:",omitempty"` // Applied to auction trades.
 	Price     decimal.Decimal
-	Remaining decimal.Decimal // Counter remaining
+	Remaining decimal.Decimal // Counter remaining (displayed)
+
+	// Iceberg orders only display a slice of their volume at a time.
+	// The slice is replenished from the hidden volume when filled.
+	Display decimal.Decimal `json:",omitempty"` // Slice size
+	Hidden  decimal.Decimal `json:",omitempty"` // Counter remaining not displayed
 }
 
 // Base returns the equivalent base amount; price * remaining.
@@ -41,10 +195,179 @@ func (o Order) Base() decimal.Decimal {
 	return o.Price.Mul(o.Remaining)
 }
 
+// OrderBook contains the bids and asks in price-time priority. The
+// zero value is an empty order book.
 type OrderBook struct {
 	Sequence int64
+
+	state  State
+	halted bool
+	ref    reference // Circuit breaker reference
+	hash   string    // Hash of the last result
+
+	bids  *side
+	asks  *side
+	stops []Command // Dormant stop orders in order of acceptance.
+}
+
+// side returns the bids or asks, creating it if required.
+func (b *OrderBook) side(isBid bool) *side {
+	if isBid {
+		if b.bids == nil {
+			b.bids = newSide(true)
+		}
+		return b.bids
+	}
+
+	if b.asks == nil {
+		b.asks = newSide(false)
+	}
+	return b.asks
+}
+
+// Bids returns the bids in priority order.
+func (b *OrderBook) Bids() []Order {
+	return b.side(true).Orders()
+}
+
+// Asks returns the asks in priority order.
+func (b *OrderBook) Asks() []Order {
+	return b.side(false).Orders()
+}
+
+// Len returns the number of bids and asks.
+func (b *OrderBook) Len() (bids int, asks int) {
+	return b.side(true).Len(), b.side(false).Len()
+}
+
+// PriceLevel is the aggregate displayed volume of orders at a price.
+type PriceLevel struct {
+	Price  decimal.Decimal
+	Volume decimal.Decimal
+	Count  int
+}
+
+// Depth returns up to n price levels per side in priority order. Only
+// displayed volume is included, hidden iceberg volume is excluded.
+func (b *OrderBook) Depth(n int) (bids []PriceLevel, asks []PriceLevel) {
+	return b.side(true).Depth(n), b.side(false).Depth(n)
+}
+
+// State returns the trading state of the order book.
+func (b *OrderBook) State() State {
+	return b.state
+}
+
+// Halted returns true if the order book is halted.
+func (b *OrderBook) Halted() bool {
+	return b.halted
+}
+
+// Hash returns the rolling hash of the last result, see NextHash.
+func (b *OrderBook) Hash() string {
+	return b.hash
+}
+
+// Stops returns the dormant stop orders in order of acceptance.
+func (b *OrderBook) Stops() []Command {
+	return append([]Command(nil), b.stops...)
+}
+
+// Snapshot returns a flat copy of the order book. It is cheap enough to
+// take on the matcher go routine, see Snapshot.
+func (b *OrderBook) Snapshot() Snapshot {
+	return Snapshot{bj: b.toJSON()}
+}
+
+// MarshalJSON returns the JSON encoding of the order book.
+func (b OrderBook) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.toJSON())
+}
+
+// UnmarshalJSON sets the order book from its JSON encoding.
+func (b *OrderBook) UnmarshalJSON(data []byte) error {
+	var bj bookJSON
+	if err := json.Unmarshal(data, &bj); err != nil {
+		return err
+	}
+
+	*b = bj.toBook()
+	return nil
+}
+
+func (b *OrderBook) toJSON() bookJSON {
+	var ref *reference
+	if !b.ref.Price.IsZero() {
+		r := b.ref
+		ref = &r
+	}
+
+	return bookJSON{
+		Sequence: b.Sequence,
+		State:    b.state,
+		Halted:   b.halted,
+		Ref:      ref,
+		Hash:     b.hash,
+		Bids:     b.Bids(),
+		Asks:     b.Asks(),
+		Stops:    b.Stops(),
+	}
+}
+
+// bookJSON is the JSON representation of an order book
+// with bids and asks in priority order.
+type bookJSON struct {
+	Sequence int64
+	State    State      `json:",omitempty"`
+	Halted   bool       `json:",omitempty"`
+	Ref      *reference `json:",omitempty"`
+	Hash     string     `json:",omitempty"`
 	Bids     []Order
 	Asks     []Order
+	Stops    []Command `json:",omitempty"`
+}
+
+// Snapshot is a flat copy of an order book with bids and asks in priority
+// order. Unlike the order book, it doesn't index the orders, so it is
+// cheap to take and may be encoded later on another go routine. Its JSON
+// encoding is that of the order book.
+type Snapshot struct {
+	bj bookJSON
+}
+
+// Sequence returns the sequence of the order book.
+func (s Snapshot) Sequence() int64 {
+	return s.bj.Sequence
+}
+
+// Book returns the order book of the snapshot.
+func (s Snapshot) Book() OrderBook {
+	return s.bj.toBook()
+}
+
+// MarshalJSON returns the JSON encoding of the order book.
+func (s Snapshot) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.bj)
+}
+
+func (bj bookJSON) toBook() OrderBook {
+	book := OrderBook{
+		Sequence: bj.Sequence,
+		state:    bj.State,
+		halted:   bj.Halted,
+		hash:     bj.Hash,
+		stops:    append([]Command(nil), bj.Stops...),
+	}
+	if bj.Ref != nil {
+		book.ref = *bj.Ref
+	}
+	for _, o := range bj.Bids {
+		book.side(true).Push(o)
+	}
+	for _, o := range bj.Asks {
+		book.side(false).Push(o)
+	}
+	return book
 }
 
 type Trade struct {
@@ -54,6 +377,15 @@ type Trade struct {
 	Volume       decimal.Decimal
 	Price        decimal.Decimal
 	IsBuy        bool
+
+	// TakerFilled is only set by auction uncross trades since both orders
+	// may be filled. The newer order is the taker.
+	TakerFilled bool `json:",omitempty" yaml:",omitempty"`
+
+	// MakerFee and TakerFee are the fees of the base amount (price*volume)
+	// at the accounts' fee rates. Negative fees are rebates.
+	MakerFee decimal.Decimal `yaml:",omitempty"`
+	TakerFee decimal.Decimal `yaml:",omitempty"`
 }
 
 //go:generate stringer -type=Type -trimprefix=Type
@@ -74,6 +406,81 @@ const (
 	TypeLimitTaker     Type = 10
 	TypeLimitPartial   Type = 11
 	TypeLimitMaker     Type = 12
+	TypeStopAccepted   Type = 13
+	TypeStopTriggered  Type = 14
+	TypeIOCCancelled   Type = 15
+	TypeFOKKilled      Type = 16
+	TypeExpired        Type = 17
+	TypeExpireFailed   Type = 18
+	TypeAmended        Type = 19
+	TypeAmendFailed    Type = 20
+
+	// TypeSelfTradeCancelled indicates the taker order was cancelled by
+	// self-trade prevention after any trades.
+	TypeSelfTradeCancelled Type = 21
+
+	// TypeRejected indicates the order was ignored since it didn't conform
+	// to the market config or the order book doesn't accept it in its
+	// current state, see Reason.
+	TypeRejected Type = 22
+
+	// TypePostSlid indicates the post only order was posted at the
+	// adjusted Result.Price since it would otherwise have traded.
+	TypePostSlid Type = 23
+
+	// TypeAuctionStarted indicates the order book moved into auction state.
+	TypeAuctionStarted Type = 24
+
+	// TypeUncrossed indicates the auction was executed at the clearing
+	// Result.Price and the order book moved back to continuous state.
+	TypeUncrossed Type = 25
+
+	// TypeAuctionFailed indicates the auction command was not applicable
+	// to the order book state.
+	TypeAuctionFailed Type = 26
+
+	// TypeHalted indicates the order book was halted.
+	TypeHalted Type = 27
+
+	// TypeResumed indicates the halted order book was resumed.
+	TypeResumed Type = 28
+
+	// TypeHaltFailed indicates the halt or resume command was not
+	// applicable since the order book was already halted or resumed.
+	TypeHaltFailed Type = 29
+
+	// TypeCircuitBreaker indicates the order book was halted by the
+	// circuit breaker after the command's trades.
+	TypeCircuitBreaker Type = 30
+
+	// TypeMassCancelled indicates the orders in Result.Cancelled were
+	// removed from the order book by a mass cancel command.
+	TypeMassCancelled Type = 31
+
+	// TypeFailed indicates the command failed unexpectedly and was
+	// rejected by the market's error policy. Trades already applied to
+	// the order book are included.
+	TypeFailed Type = 32
+)
+
+//go:generate stringer -type=Reason -trimprefix=Reason
+
+// Reason explains why a command wasn't (completely) applied.
+type Reason int
+
+const (
+	ReasonUnknown Reason = 0
+
+	// ReasonPriceProtection indicates a market order stopped trading at its
+	// worst price or max slippage.
+	ReasonPriceProtection Reason = 1
+
+	// ReasonAuction indicates the order type is not supported during an
+	// auction.
+	ReasonAuction Reason = 2
+
+	// ReasonHalted indicates the order book is halted.
+	ReasonHalted Reason = 3
 )
 
 type Result struct {
@@ -81,4 +488,30 @@ type Result struct {
 	OrderID  int64
 	Type     Type
 	Trades   []Trade
+
+	// Price is the effective price of slid post only orders or
+	// the clearing price of uncrossed auctions.
+	Price decimal.Decimal
+
+	// Reason explains the result type, if applicable.
+	Reason Reason `json:",omitempty"`
+
+	// Cancelled contains the maker orders removed from the book by
+	// self-trade prevention or the orders removed by mass cancel.
+	Cancelled []int64 `json:",omitempty"`
+
+	// Triggered contains the results of stop orders triggered by this
+	// command's trades. Each triggered stop has a TypeStopTriggered result
+	// followed by the result of the resulting market or limit order.
+	// A final TypeCircuitBreaker result indicates the order book was
+	// halted by the circuit breaker.
+	Triggered []Result `json:",omitempty"`
+
+	// Hash is the rolling hash of the order book after the command,
+	// see NextHash. Noops aren't hashed.
+	Hash string `json:",omitempty"`
+
+	// MatchedAt is when the matcher output the result. It isn't stored
+	// since it differs when replayed.
+	MatchedAt time.Time `json:"-"`
 }
@@ -14,17 +14,23 @@ type want interface {
 	IsFilled() bool
 }
 
+// wantMarketBase buys counter volume by spending the base amount.
 type wantMarketBase struct {
 	remaining decimal.Decimal // Base
-	scale     int
+	scale     int             // Counter scale
+	limit     decimal.Decimal // Optional price protection
 }
 
 func (w *wantMarketBase) PriceLimit() decimal.Decimal {
-	return decimal.Zero
+	return w.limit
 }
 
+// Remaining returns the counter volume the remaining base amount buys at
+// the price, rounded down to the counter scale so that the base amount is
+// never overspent. It returns zero if the remaining base is dust.
 func (w *wantMarketBase) Remaining(price decimal.Decimal) (counter decimal.Decimal) {
-	return w.remaining.DivRound(price, int32(w.scale))
+	counter, _ = w.remaining.QuoRem(price, int32(w.scale))
+	return counter
 }
 
 func (w *wantMarketBase) Fill(counter, price decimal.Decimal) {
@@ -40,12 +46,46 @@ func (w *wantMarketBase) IsFilled() bool {
 	return w.remaining.Sign() == 0
 }
 
+// wantSellBase sells counter volume until the base amount is received.
+type wantSellBase struct {
+	remaining decimal.Decimal // Base
+	scale     int             // Counter scale
+	limit     decimal.Decimal // Optional price protection
+}
+
+func (w *wantSellBase) PriceLimit() decimal.Decimal {
+	return w.limit
+}
+
+// Remaining returns the counter volume of the remaining base amount at
+// the price, rounded down to the counter scale so that the base amount is
+// never exceeded. It returns zero if the remaining base is less than the
+// smallest volume at the price.
+func (w *wantSellBase) Remaining(price decimal.Decimal) (counter decimal.Decimal) {
+	counter, _ = w.remaining.QuoRem(price, int32(w.scale))
+	return counter
+}
+
+func (w *wantSellBase) Fill(counter, price decimal.Decimal) {
+	base := counter.Mul(price)
+	w.remaining = w.remaining.Sub(base)
+}
+
+func (w *wantSellBase) Filled() {
+	w.remaining = decimal.Zero
+}
+
+func (w *wantSellBase) IsFilled() bool {
+	return w.remaining.Sign() == 0
+}
+
 type wantMarketCounter struct {
 	remaining decimal.Decimal // Counter
+	limit     decimal.Decimal // Optional price protection
 }
 
 func (w *wantMarketCounter) PriceLimit() decimal.Decimal {
-	return decimal.Zero
+	return w.limit
 }
 
 func (w *wantMarketCounter) Remaining(_ decimal.Decimal) (counter decimal.Decimal) {
@@ -1,23 +1,63 @@
 package exchange
 
 import (
+	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/corverroos/exchange/matcher"
+	"github.com/luno/jettison/errors"
+	"github.com/luno/reflex"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type Metrics struct {
-	getInput       func() int
-	getOutput      func() int
+	mu     sync.Mutex
+	queues map[string]queueLens // Channel lengths by market
+
 	count          int64 // Used with amotic
 	latencyNanoSum int64
 	latencyCount   int64
 }
 
+// queueLens returns the lengths of a market's input and output channels.
+type queueLens struct {
+	input  func() int
+	output func() int
+}
+
+func (m *Metrics) setQueues(market string, input, output func() int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.queues == nil {
+		m.queues = make(map[string]queueLens)
+	}
+	m.queues[market] = queueLens{input: input, output: output}
+}
+
+// InputLen returns the total length of all markets' input channels.
 func (m *Metrics) InputLen() int {
-	return m.getInput()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int
+	for _, q := range m.queues {
+		n += q.input()
+	}
+	return n
 }
+
+// OutputLen returns the total length of all markets' output channels.
 func (m *Metrics) OutputLen() int {
-	return m.getOutput()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int
+	for _, q := range m.queues {
+		n += q.output()
+	}
+	return n
 }
 func (m *Metrics) Count() int64 {
 	return atomic.LoadInt64(&m.count)
@@ -33,8 +73,201 @@ func (m *Metrics) latency() func() {
 		atomic.AddInt64(&m.latencyCount, 1)
 	}
 }
+
+// MeanLatency returns the mean MatchCommand latency or zero if no
+// commands were matched yet.
 func (m *Metrics) MeanLatency() time.Duration {
 	nanos := atomic.LoadInt64(&m.latencyNanoSum)
 	count := atomic.LoadInt64(&m.latencyCount)
+	if count == 0 {
+		return 0
+	}
 	return time.Duration(nanos / count)
 }
+
+// collector is the prometheus collector of the exchange pipeline. A nil
+// collector ignores all observations.
+type collector struct {
+	mu     sync.Mutex
+	queues map[string]queueLens // Channel lengths by market
+
+	inputLen  *prometheus.Desc
+	outputLen *prometheus.Desc
+
+	commands     *prometheus.CounterVec
+	trades       *prometheus.CounterVec
+	tradeVolume  *prometheus.CounterVec
+	matchLatency *prometheus.HistogramVec
+	batchSize    *prometheus.HistogramVec
+	writeLatency *prometheus.HistogramVec
+	consumerLag  *prometheus.GaugeVec
+	stageLatency *prometheus.HistogramVec
+}
+
+func newCollector() *collector {
+	return &collector{
+		inputLen: prometheus.NewDesc("exchange_input_queue_length",
+			"Length of the matcher input channel.", []string{"market"}, nil),
+		outputLen: prometheus.NewDesc("exchange_output_queue_length",
+			"Length of the matcher output channel.", []string{"market"}, nil),
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "exchange_commands_total",
+			Help: "Commands and triggered orders matched by result type excluding noops.",
+		}, []string{"market", "type"}),
+		trades: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "exchange_trades_total",
+			Help: "Trades matched.",
+		}, []string{"market"}),
+		tradeVolume: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "exchange_trade_volume_total",
+			Help: "Counter volume of trades matched.",
+		}, []string{"market"}),
+		matchLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "exchange_match_latency_seconds",
+			Help:    "MatchCommand latency.",
+			Buckets: prometheus.ExponentialBuckets(1e-6, 4, 10), // 1us to 262ms
+		}, []string{"market"}),
+		batchSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "exchange_results_batch_size",
+			Help:    "Number of results stored per batch.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 10), // 1 to 512
+		}, []string{"market"}),
+		writeLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "exchange_results_write_latency_seconds",
+			Help: "Latency of storing a batch of results.",
+		}, []string{"market"}),
+		consumerLag: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "exchange_consumer_lag_seconds",
+			Help: "Time since the last consumed event was inserted.",
+		}, []string{"cursor"}),
+		stageLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "exchange_stage_latency_seconds",
+			Help:    "Latency of order commands per pipeline stage, see Trace.",
+			Buckets: prometheus.ExponentialBuckets(1e-4, 4, 10), // 100us to 26s
+		}, []string{"stage"}),
+	}
+}
+
+// register registers a new collector with the registry or returns
+// the collector already registered.
+func register(reg prometheus.Registerer) (*collector, error) {
+	c := newCollector()
+
+	err := reg.Register(c)
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		existing, ok := are.ExistingCollector.(*collector)
+		if !ok {
+			return nil, err
+		}
+		return existing, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.inputLen
+	ch <- c.outputLen
+	c.commands.Describe(ch)
+	c.trades.Describe(ch)
+	c.tradeVolume.Describe(ch)
+	c.matchLatency.Describe(ch)
+	c.batchSize.Describe(ch)
+	c.writeLatency.Describe(ch)
+	c.consumerLag.Describe(ch)
+	c.stageLatency.Describe(ch)
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	for market, q := range c.queues {
+		ch <- prometheus.MustNewConstMetric(c.inputLen,
+			prometheus.GaugeValue, float64(q.input()), market)
+		ch <- prometheus.MustNewConstMetric(c.outputLen,
+			prometheus.GaugeValue, float64(q.output()), market)
+	}
+	c.mu.Unlock()
+
+	c.commands.Collect(ch)
+	c.trades.Collect(ch)
+	c.tradeVolume.Collect(ch)
+	c.matchLatency.Collect(ch)
+	c.batchSize.Collect(ch)
+	c.writeLatency.Collect(ch)
+	c.consumerLag.Collect(ch)
+	c.stageLatency.Collect(ch)
+}
+
+func (c *collector) setQueues(market string, input, output func() int) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.queues == nil {
+		c.queues = make(map[string]queueLens)
+	}
+	c.queues[market] = queueLens{input: input, output: output}
+}
+
+// latency returns a function that wraps the MatchCommand latency function
+// additionally observing the market's match latency.
+func (c *collector) latency(market string, next func() func()) func() func() {
+	if c == nil {
+		return next
+	}
+
+	o := c.matchLatency.WithLabelValues(market)
+	return func() func() {
+		t0 := time.Now()
+		done := next()
+		return func() {
+			done()
+			o.Observe(time.Since(t0).Seconds())
+		}
+	}
+}
+
+// observeBatch observes the market's stored batch of results and
+// the time it took to store.
+func (c *collector) observeBatch(market string, rl []matcher.Result, d time.Duration) {
+	if c == nil {
+		return
+	}
+
+	c.batchSize.WithLabelValues(market).Observe(float64(len(rl)))
+	c.writeLatency.WithLabelValues(market).Observe(d.Seconds())
+
+	for _, r := range flatten(rl) {
+		c.commands.WithLabelValues(market, r.Type.String()).Inc()
+
+		for _, t := range r.Trades {
+			c.trades.WithLabelValues(market).Inc()
+			volume, _ := t.Volume.Float64()
+			c.tradeVolume.WithLabelValues(market).Add(volume)
+		}
+	}
+}
+
+// observeLag observes the lag of the cursor's consumer.
+func (c *collector) observeLag(cursor string, e *reflex.Event) {
+	if c == nil {
+		return
+	}
+
+	c.consumerLag.WithLabelValues(cursor).Set(time.Since(e.Timestamp).Seconds())
+}
+
+// observeStage observes the latency of the pipeline stage.
+func (c *collector) observeStage(stage string, d time.Duration) {
+	if c == nil {
+		return
+	}
+
+	c.stageLatency.WithLabelValues(stage).Observe(d.Seconds())
+}
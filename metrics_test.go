@@ -0,0 +1,92 @@
+package exchange
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/corverroos/exchange/matcher"
+	"github.com/luno/jettison/jtest"
+	"github.com/luno/reflex"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMeanLatency(t *testing.T) {
+	m := new(Metrics)
+	require.Equal(t, time.Duration(0), m.MeanLatency())
+
+	done := m.latency()
+	time.Sleep(time.Millisecond)
+	done()
+	require.True(t, m.MeanLatency() >= time.Millisecond)
+}
+
+func TestCollector(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	c, err := register(reg)
+	jtest.Require(t, nil, err)
+
+	// Registering again returns the existing collector.
+	c2, err := register(reg)
+	jtest.Require(t, nil, err)
+	require.True(t, c == c2)
+
+	c.setQueues("BTCUSD", func() int { return 3 }, func() int { return 1 })
+	c.latency("BTCUSD", func() func() { return func() {} })()()
+	c.observeBatch("BTCUSD", []matcher.Result{
+		{Sequence: 1, Type: matcher.TypeLimitMaker},
+		{Sequence: 2, Type: matcher.TypeLimitTaker, Trades: []matcher.Trade{
+			{Volume: d(2)},
+		}, Triggered: []matcher.Result{
+			{Sequence: 2, Type: matcher.TypeStopTriggered},
+			{Sequence: 2, Type: matcher.TypeMarketFull, Trades: []matcher.Trade{
+				{Volume: d(1)},
+			}},
+		}},
+	}, time.Millisecond)
+	c.observeLag("matcher", &reflex.Event{Timestamp: time.Now()})
+
+	expect := `
+# HELP exchange_commands_total Commands and triggered orders matched by result type excluding noops.
+# TYPE exchange_commands_total counter
+exchange_commands_total{market="BTCUSD",type="LimitMaker"} 1
+exchange_commands_total{market="BTCUSD",type="LimitTaker"} 1
+exchange_commands_total{market="BTCUSD",type="MarketFull"} 1
+exchange_commands_total{market="BTCUSD",type="StopTriggered"} 1
+# HELP exchange_input_queue_length Length of the matcher input channel.
+# TYPE exchange_input_queue_length gauge
+exchange_input_queue_length{market="BTCUSD"} 3
+# HELP exchange_output_queue_length Length of the matcher output channel.
+# TYPE exchange_output_queue_length gauge
+exchange_output_queue_length{market="BTCUSD"} 1
+# HELP exchange_trade_volume_total Counter volume of trades matched.
+# TYPE exchange_trade_volume_total counter
+exchange_trade_volume_total{market="BTCUSD"} 3
+# HELP exchange_trades_total Trades matched.
+# TYPE exchange_trades_total counter
+exchange_trades_total{market="BTCUSD"} 2
+`
+	err = testutil.GatherAndCompare(reg, strings.NewReader(expect),
+		"exchange_commands_total", "exchange_input_queue_length",
+		"exchange_output_queue_length", "exchange_trade_volume_total",
+		"exchange_trades_total")
+	jtest.Require(t, nil, err)
+
+	mfs, err := reg.Gather()
+	jtest.Require(t, nil, err)
+	names := make(map[string]bool)
+	for _, mf := range mfs {
+		names[mf.GetName()] = true
+	}
+	for _, name := range []string{
+		"exchange_match_latency_seconds",
+		"exchange_results_batch_size",
+		"exchange_results_write_latency_seconds",
+		"exchange_consumer_lag_seconds",
+	} {
+		require.True(t, names[name], name)
+	}
+}
@@ -0,0 +1,221 @@
+package exchange
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+
+	"github.com/corverroos/exchange/db/results"
+	"github.com/corverroos/exchange/markets"
+	"github.com/corverroos/exchange/matcher"
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/j"
+)
+
+// LoadCommands returns the market's matcher commands of the order events
+// up to and including the sequence.
+func LoadCommands(ctx context.Context, dbc *sql.DB, market string,
+	seq int64) ([]matcher.Command, error) {
+
+	var cl []matcher.Command
+	err := streamCommands(ctx, dbc, market, 0, seq,
+		func(cmd matcher.Command) error {
+			cl = append(cl, cmd)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return cl, nil
+}
+
+// LoadResults returns the market's stored matcher results in order and
+// the sequence of the last result. See mergeResults.
+func LoadResults(ctx context.Context, dbc *sql.DB, market string) ([]matcher.Result, int64, error) {
+	rl, err := results.ListInMarket(ctx, dbc, market)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	res, seq := mergeResults(rl)
+
+	return res, seq, nil
+}
+
+// mergeResults returns the results of the batches in order and the
+// sequence of the last result. Results stored again after a crash before
+// the cursor was updated are skipped; they are identical since matching
+// is deterministic.
+func mergeResults(rl []results.Result) ([]matcher.Result, int64) {
+	var (
+		res []matcher.Result
+		seq int64
+	)
+	for _, r := range rl {
+		for _, result := range r.Results {
+			if result.Sequence <= seq {
+				// Duplicate
+				continue
+			}
+
+			res = append(res, result)
+			seq = result.Sequence
+		}
+	}
+
+	return res, seq
+}
+
+// WriteCommands writes the commands as JSON lines.
+func WriteCommands(w io.Writer, cl []matcher.Command) error {
+	enc := json.NewEncoder(w)
+	for _, cmd := range cl {
+		if err := enc.Encode(cmd); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadCommands returns the commands of the JSON lines.
+func ReadCommands(r io.Reader) ([]matcher.Command, error) {
+	var cl []matcher.Command
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var cmd matcher.Command
+		err := dec.Decode(&cmd)
+		if errors.Is(err, io.EOF) {
+			return cl, nil
+		} else if err != nil {
+			return nil, errors.Wrap(err, "invalid command",
+				j.KV("index", len(cl)))
+		}
+
+		cl = append(cl, cmd)
+	}
+}
+
+// Replay matches the market's commands against an empty order book and
+// returns the results. It fills sequence gaps with noops like the live
+// matcher, so the results are identical to those stored by Run.
+func Replay(ctx context.Context, cl []matcher.Command,
+	cfg markets.Config) ([]matcher.Result, error) {
+
+	if len(cl) == 0 {
+		return nil, nil
+	}
+
+	// Stop all go routines when done.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	input := make(chan matcher.Command, 1000)
+	output := make(chan matcher.Result, 1000)
+
+	errc := goChan(func() error {
+		return matcher.Match(ctx, matcher.OrderBook{}, input, output, cfg,
+			func(*matcher.OrderBook) {}, func() func() { return func() {} })
+	})
+
+	go func() {
+		var prev int64
+		for _, cmd := range cl {
+			for i := prev + 1; i <= cmd.Sequence; i++ {
+				next := matcher.Command{Sequence: i}
+				if i == cmd.Sequence {
+					next = cmd
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case input <- next:
+				}
+			}
+			prev = cmd.Sequence
+		}
+	}()
+
+	last := cl[len(cl)-1].Sequence
+
+	var rl []matcher.Result
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case err := <-errc:
+			return nil, err
+		case r := <-output:
+			if r.Type != matcher.TypeCommandUnknown {
+				rl = append(rl, r)
+			}
+			if r.Sequence == last {
+				return rl, nil
+			}
+		}
+	}
+}
+
+// FirstBrokenHash verifies the rolling hash chain of the stored results
+// of the commands and returns the sequence of the first result with an
+// invalid hash. It returns false if the hash chain is valid.
+func FirstBrokenHash(cl []matcher.Command, stored []matcher.Result) (int64, bool, error) {
+	var prev string
+	for i, r := range stored {
+		if i >= len(cl) || cl[i].Sequence != r.Sequence {
+			return r.Sequence, true, nil
+		}
+
+		hash, err := matcher.NextHash(prev, cl[i], r)
+		if err != nil {
+			return 0, false, err
+		} else if hash != r.Hash {
+			return r.Sequence, true, nil
+		}
+
+		prev = r.Hash
+	}
+
+	return 0, false, nil
+}
+
+// FirstDivergence compares the JSON encoding, including the rolling hash,
+// of the stored and replayed results and returns the sequence of the first
+// result that differs. It returns false if the results are identical.
+func FirstDivergence(stored, replayed []matcher.Result) (int64, bool, error) {
+	for i := 0; i < len(stored) && i < len(replayed); i++ {
+		a, err := json.Marshal(stored[i])
+		if err != nil {
+			return 0, false, err
+		}
+
+		b, err := json.Marshal(replayed[i])
+		if err != nil {
+			return 0, false, err
+		}
+
+		if bytes.Equal(a, b) {
+			continue
+		}
+
+		seq := stored[i].Sequence
+		if replayed[i].Sequence < seq {
+			seq = replayed[i].Sequence
+		}
+
+		return seq, true, nil
+	}
+
+	if len(stored) > len(replayed) {
+		return stored[len(replayed)].Sequence, true, nil
+	} else if len(replayed) > len(stored) {
+		return replayed[len(stored)].Sequence, true, nil
+	}
+
+	return 0, false, nil
+}
@@ -0,0 +1,63 @@
+package exchange
+
+import (
+	"context"
+	"testing"
+
+	"github.com/corverroos/exchange/db/results"
+	"github.com/corverroos/exchange/markets"
+	"github.com/corverroos/exchange/matcher"
+	"github.com/luno/jettison/jtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeResults(t *testing.T) {
+	cl := []matcher.Command{
+		{Sequence: 1, Type: matcher.CommandLimit, OrderID: 1, LimitPrice: d(100), LimitVolume: d(1)},
+		{Sequence: 3, Type: matcher.CommandLimit, OrderID: 3, LimitPrice: d(100), LimitVolume: d(1)},
+		{Sequence: 4, Type: matcher.CommandLimit, OrderID: 4, LimitPrice: d(100), LimitVolume: d(2), IsBuy: true},
+	}
+
+	var (
+		book matcher.OrderBook
+		rl   []matcher.Result
+	)
+	for _, cmd := range cl {
+		r, err := matcher.MatchCommand(&book, cmd, markets.Default)
+		jtest.Require(t, nil, err)
+		rl = append(rl, r)
+	}
+
+	// The second batch was stored again after a crash before the cursor
+	// was updated, followed by the next batch.
+	batches := []results.Result{
+		{MarketSeq: 1, Results: rl[:1]},
+		{MarketSeq: 2, Results: rl[1:2]},
+		{MarketSeq: 3, Results: rl[1:2]},
+		{MarketSeq: 4, Results: rl[2:]},
+	}
+
+	var flat []matcher.Result
+	for _, b := range batches {
+		flat = append(flat, b.Results...)
+	}
+	first, broken, err := FirstBrokenHash(cl, flat)
+	jtest.Require(t, nil, err)
+	require.True(t, broken)
+	require.Equal(t, int64(3), first)
+
+	stored, seq := mergeResults(batches)
+	require.Equal(t, rl, stored)
+	require.Equal(t, int64(4), seq)
+
+	_, broken, err = FirstBrokenHash(cl, stored)
+	jtest.Require(t, nil, err)
+	require.False(t, broken)
+
+	replayed, err := Replay(context.Background(), cl, markets.Default)
+	jtest.Require(t, nil, err)
+
+	_, diverged, err := FirstDivergence(stored, replayed)
+	jtest.Require(t, nil, err)
+	require.False(t, diverged)
+}
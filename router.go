@@ -0,0 +1,220 @@
+package exchange
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/j"
+	"github.com/luno/jettison/log"
+	"github.com/luno/reflex"
+)
+
+// errInputFull indicates the matcher's input channel is full.
+var errInputFull = errors.New("matcher input full", j.C("ERR_117a4cdb33bd6731"))
+
+// router streams new order events once and routes their commands to the
+// market matchers that are live. Matchers first catch up from their own
+// cursor with a private stream and then join the shared stream. Matchers
+// whose input is full fall back to catching up, so a slow, failing or
+// restarting market doesn't block or rewind the others.
+type router struct {
+	stream reflex.StreamFunc
+
+	mu     sync.Mutex
+	routes map[string]*route // By market
+	pos    int64             // Last event routed, zero if unknown.
+}
+
+// route is a market matcher's route; either live on the shared stream or
+// catching up.
+type route struct {
+	s      *state
+	live   bool
+	behind chan struct{} // Signals falling behind the shared stream.
+}
+
+func newRouter(stream reflex.StreamFunc) *router {
+	return &router{
+		stream: stream,
+		routes: make(map[string]*route),
+	}
+}
+
+// Follow routes the market's commands to the state until the context is
+// done or catching up fails.
+func (r *router) Follow(ctx context.Context, s *state) error {
+	rt := &route{s: s, behind: make(chan struct{}, 1)}
+
+	r.mu.Lock()
+	r.routes[s.market] = rt
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		if r.routes[s.market] == rt {
+			delete(r.routes, s.market)
+		}
+	}()
+
+	for {
+		if err := r.catchUp(ctx, rt); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-rt.behind:
+		}
+	}
+}
+
+// catchUp enqueues the market's commands of the order events after the
+// last sent sequence until it reaches the shared stream's position, then
+// marks the route live.
+func (r *router) catchUp(ctx context.Context, rt *route) error {
+	// Stop the stream when done.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sc, err := r.stream(ctx, strconv.FormatInt(rt.s.lastSent(), 10))
+	if err != nil {
+		return err
+	}
+
+	for {
+		e, err := sc.Recv()
+		if err != nil {
+			return err
+		}
+
+		cmd, ok, err := makeCommand(e)
+		if ok && cmd.Market == rt.s.market {
+			if err != nil {
+				// The market's error policy applies to the invalid command.
+				log.Error(ctx, errors.Wrap(err, "invalid order event",
+					j.MKV{"seq": e.ID, "market": cmd.Market}))
+			}
+
+			if err := rt.s.Enqueue(ctx, e, cmd, true); err != nil {
+				return err
+			}
+		}
+
+		if r.join(rt, e.IDInt()) {
+			return nil
+		}
+	}
+}
+
+// join marks the route live and returns true if the sequence reached the
+// shared stream's position.
+func (r *router) join(rt *route, seq int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.pos == 0 || seq < r.pos {
+		return false
+	}
+
+	rt.live = true
+	return true
+}
+
+// advance sets the shared stream's position.
+func (r *router) advance(seq int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pos = seq
+}
+
+// lookup returns the market's route if live or nil.
+func (r *router) lookup(market string) *route {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rt := r.routes[market]
+	if rt == nil || !rt.live {
+		return nil
+	}
+
+	return rt
+}
+
+// fallBehind moves the routes back to catching up.
+func (r *router) fallBehind(rl ...*route) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, rt := range rl {
+		if !rt.live {
+			continue
+		}
+
+		rt.live = false
+		rt.behind <- struct{}{}
+	}
+}
+
+// Run routes new order events until the context is done, returning the
+// first error.
+func (r *router) Run(ctx context.Context) error {
+	// Events may have been missed since the previous run.
+	r.mu.Lock()
+	r.pos = 0
+	var rl []*route
+	for _, rt := range r.routes {
+		rl = append(rl, rt)
+	}
+	r.mu.Unlock()
+	r.fallBehind(rl...)
+
+	// Stop the stream when done.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sc, err := r.stream(ctx, "", reflex.WithStreamFromHead())
+	if err != nil {
+		return err
+	}
+
+	for {
+		e, err := sc.Recv()
+		if err != nil {
+			return err
+		}
+
+		// Routes catching up enqueue events up to this position.
+		r.advance(e.IDInt())
+
+		cmd, ok, err := makeCommand(e)
+		if !ok {
+			continue
+		}
+
+		rt := r.lookup(cmd.Market)
+		if rt == nil {
+			// Market catching up or restarting.
+			continue
+		}
+
+		if err != nil {
+			// The market's error policy applies to the invalid command.
+			log.Error(ctx, errors.Wrap(err, "invalid order event",
+				j.MKV{"seq": e.ID, "market": cmd.Market}))
+		}
+
+		err = rt.s.Enqueue(ctx, e, cmd, false)
+		if errors.Is(err, errInputFull) {
+			// Don't block other markets.
+			r.fallBehind(rt)
+		} else if err != nil {
+			return err
+		}
+	}
+}
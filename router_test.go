@@ -0,0 +1,292 @@
+package exchange
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/corverroos/exchange/db/orders"
+	"github.com/corverroos/exchange/matcher"
+	"github.com/luno/jettison/jtest"
+	"github.com/luno/reflex"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouter(t *testing.T) {
+	const eth = "ETHBTC"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := new(testLog)
+	l.Limit(t, orders.DefaultMarket)
+	l.Limit(t, eth)
+	l.Limit(t, orders.DefaultMarket)
+
+	r := newRouter(l.Stream)
+	go func() {
+		jtest.Assert(t, context.Canceled, r.Run(ctx))
+	}()
+
+	// Markets catch up from their cursor, other markets' events are
+	// filled with noops.
+	def, stopDef := follow(ctx, r, orders.DefaultMarket, 0, 10)
+	expectCommands(t, def, 1, matcher.CommandLimit,
+		matcher.CommandUnknown, matcher.CommandLimit)
+
+	l.Limit(t, eth)
+	l.Limit(t, orders.DefaultMarket)
+	expectCommands(t, def, 4, matcher.CommandUnknown, matcher.CommandLimit)
+
+	// New markets catch up without affecting the other market.
+	ethState, _ := follow(ctx, r, eth, 0, 10)
+	expectCommands(t, ethState, 1, matcher.CommandUnknown,
+		matcher.CommandLimit, matcher.CommandUnknown, matcher.CommandLimit)
+
+	// Restarted markets continue after their cursor.
+	stopDef()
+	def, _ = follow(ctx, r, orders.DefaultMarket, 3, 10)
+	expectCommands(t, def, 4, matcher.CommandUnknown, matcher.CommandLimit)
+
+	l.Limit(t, orders.DefaultMarket)
+	expectCommands(t, def, 6, matcher.CommandLimit)
+
+	time.Sleep(10 * time.Millisecond)
+	require.Len(t, def.input, 0)
+	require.Len(t, ethState.input, 0)
+}
+
+func TestRouterInputFull(t *testing.T) {
+	const eth = "ETHBTC"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := new(testLog)
+	r := newRouter(l.Stream)
+	go func() {
+		jtest.Assert(t, context.Canceled, r.Run(ctx))
+	}()
+
+	def, _ := follow(ctx, r, orders.DefaultMarket, 0, 1)
+	ethState, _ := follow(ctx, r, eth, 0, 10)
+
+	// Add events until both markets are routed live.
+	var n int64
+	for i := 0; r.lookup(orders.DefaultMarket) == nil || r.lookup(eth) == nil; i++ {
+		require.Less(t, i, 100)
+
+		l.Limit(t, orders.DefaultMarket)
+		l.Limit(t, eth)
+		n += 2
+		expectNext(t, def, n-1, matcher.CommandLimit)
+		expectNext(t, ethState, n, matcher.CommandLimit)
+		time.Sleep(time.Millisecond)
+	}
+
+	// Fill the default market's input.
+	l.Limit(t, orders.DefaultMarket)
+	l.Limit(t, orders.DefaultMarket)
+	l.Limit(t, eth)
+
+	// The default market falls behind without blocking the other market.
+	expectNext(t, ethState, n+3, matcher.CommandLimit)
+	require.Eventually(t, func() bool {
+		return r.lookup(orders.DefaultMarket) == nil
+	}, time.Second, time.Millisecond)
+
+	// It catches up once drained and rejoins.
+	expectNext(t, def, n+1, matcher.CommandLimit)
+	expectCommands(t, def, n+2, matcher.CommandLimit)
+	n += 3
+
+	for i := 0; r.lookup(orders.DefaultMarket) == nil; i++ {
+		require.Less(t, i, 100)
+
+		l.Limit(t, orders.DefaultMarket)
+		n++
+		expectNext(t, def, n, matcher.CommandLimit)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRouterInvalid(t *testing.T) {
+	const eth = "ETHBTC"
+
+	unsupported, err := json.Marshal(orders.CreateReq{
+		Market: eth,
+		Type:   orders.Type(99),
+	})
+	jtest.Require(t, nil, err)
+
+	l := new(testLog)
+	l.Limit(t, orders.DefaultMarket)
+	l.Add(unsupported)
+	l.Add([]byte("malformed"))
+	l.Limit(t, orders.DefaultMarket)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := newRouter(l.Stream)
+	go func() {
+		jtest.Assert(t, context.Canceled, r.Run(ctx))
+	}()
+
+	def, _ := follow(ctx, r, orders.DefaultMarket, 0, 10)
+	ethState, _ := follow(ctx, r, eth, 0, 10)
+
+	// Invalid events are routed to their market, malformed metadata to
+	// the default market, without stopping the router.
+	expectCommands(t, def, 1, matcher.CommandLimit, matcher.CommandUnknown,
+		matcher.CommandInvalid, matcher.CommandLimit)
+	expectCommands(t, ethState, 1, matcher.CommandUnknown,
+		matcher.CommandInvalid)
+}
+
+// follow routes the market's commands after the sequence to a new state
+// with the input capacity and returns it with a function to stop it.
+func follow(ctx context.Context, r *router, market string, sent int64,
+	capacity int) (*state, func()) {
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	s := &state{
+		market: market,
+		input:  make(chan matcher.Command, capacity),
+		sent:   sent,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = r.Follow(ctx, s)
+	}()
+
+	return s, func() {
+		cancel()
+		<-done
+	}
+}
+
+// expectCommands requires the next commands of the state to have the types
+// and consecutive sequences from seq.
+func expectCommands(t *testing.T, s *state, seq int64,
+	types ...matcher.CommandType) {
+
+	for i, typ := range types {
+		select {
+		case cmd := <-s.input:
+			require.Equal(t, seq+int64(i), cmd.Sequence)
+			require.Equal(t, typ, cmd.Type)
+		case <-time.After(time.Second):
+			require.Fail(t, "timeout waiting for command")
+		}
+	}
+}
+
+// expectNext requires the next commands of the state up to the sequence
+// to be noops followed by a command of the type.
+func expectNext(t *testing.T, s *state, seq int64, typ matcher.CommandType) {
+	for {
+		select {
+		case cmd := <-s.input:
+			if cmd.Sequence < seq {
+				require.Equal(t, matcher.CommandUnknown, cmd.Type)
+				continue
+			}
+			require.Equal(t, seq, cmd.Sequence)
+			require.Equal(t, typ, cmd.Type)
+			return
+		case <-time.After(time.Second):
+			require.Fail(t, "timeout waiting for command")
+		}
+	}
+}
+
+// testLog is an in-memory order events log.
+type testLog struct {
+	mu     sync.Mutex
+	events []*reflex.Event
+}
+
+// Add appends a pending order event with the metadata.
+func (l *testLog) Add(meta []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	id := strconv.Itoa(len(l.events) + 1)
+	l.events = append(l.events, &reflex.Event{
+		ID:        id,
+		ForeignID: id,
+		Type:      orders.StatusPending,
+		MetaData:  meta,
+	})
+}
+
+// Limit appends a limit order event of the market.
+func (l *testLog) Limit(t *testing.T, market string) {
+	b, err := json.Marshal(orders.CreateReq{
+		Market:      market,
+		Type:        orders.TypeLimit,
+		LimitPrice:  d(100),
+		LimitVolume: d(1),
+	})
+	jtest.Require(t, nil, err)
+
+	l.Add(b)
+}
+
+// Stream implements reflex.StreamFunc.
+func (l *testLog) Stream(ctx context.Context, after string,
+	opts ...reflex.StreamOption) (reflex.StreamClient, error) {
+
+	var o reflex.StreamOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if o.StreamFromHead {
+		return &testStream{ctx: ctx, log: l, next: len(l.events)}, nil
+	}
+
+	seq, err := strconv.ParseInt(after, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &testStream{ctx: ctx, log: l, next: int(seq)}, nil
+}
+
+// testStream streams the log's events, waiting for new events until the
+// context is done.
+type testStream struct {
+	ctx  context.Context
+	log  *testLog
+	next int
+}
+
+func (s *testStream) Recv() (*reflex.Event, error) {
+	for {
+		s.log.mu.Lock()
+		if s.next < len(s.log.events) {
+			e := s.log.events[s.next]
+			s.next++
+			s.log.mu.Unlock()
+			return e, nil
+		}
+		s.log.mu.Unlock()
+
+		select {
+		case <-s.ctx.Done():
+			return nil, s.ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package exchange
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/corverroos/exchange/db/snapshots"
+	"github.com/corverroos/exchange/matcher"
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/log"
+)
+
+// snapshotter periodically stores order book snapshots without blocking
+// the matcher.
+type snapshotter struct {
+	market string
+	every  int64         // Snapshot at least every N commands.
+	period time.Duration // Snapshot at least every T duration.
+	keep   int           // Number of snapshots to retain.
+
+	books    chan matcher.Snapshot
+	lastSeq  int64
+	lastTime time.Time
+}
+
+func newSnapshotter(market string, every int64, period time.Duration, keep int) *snapshotter {
+	return &snapshotter{
+		market:   market,
+		every:    every,
+		period:   period,
+		keep:     keep,
+		books:    make(chan matcher.Snapshot, 1),
+		lastTime: time.Now(),
+	}
+}
+
+// Maybe queues a flat copy of the order book for storing if a snapshot is
+// due. It should only be called from the matcher go routine; encoding and
+// storing the copy is left to Store.
+func (s *snapshotter) Maybe(book *matcher.OrderBook) {
+	if s.every <= 0 && s.period <= 0 {
+		// Snapshots disabled.
+		return
+	}
+
+	dueSeq := s.every > 0 && book.Sequence-s.lastSeq >= s.every
+	dueTime := s.period > 0 && time.Since(s.lastTime) >= s.period
+	if !dueSeq && !dueTime {
+		return
+	}
+
+	if len(s.books) > 0 {
+		// Previous snapshot not stored yet, try again later.
+		return
+	}
+
+	s.books <- book.Snapshot()
+	s.lastSeq = book.Sequence
+	s.lastTime = time.Now()
+}
+
+// Store stores queued snapshots and deletes old ones. Errors are logged
+// since snapshots only speed up recovery.
+func (s *snapshotter) Store(ctx context.Context, dbc *sql.DB) error {
+	for {
+		var snap matcher.Snapshot
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case snap = <-s.books:
+		}
+
+		_, err := snapshots.Create(ctx, dbc, s.market, snap)
+		if err != nil {
+			log.Error(ctx, errors.Wrap(err, "store snapshot error"))
+			continue
+		}
+
+		err = snapshots.DeleteAllButLast(ctx, dbc, s.market, s.keep)
+		if err != nil {
+			log.Error(ctx, errors.Wrap(err, "delete snapshots error"))
+		}
+	}
+}
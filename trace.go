@@ -0,0 +1,197 @@
+package exchange
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/corverroos/exchange/db/orders"
+)
+
+// defaultTraceLimit is the number of traces kept if stage latency metrics
+// are enabled without a tracer.
+const defaultTraceLimit = 10000
+
+// Pipeline stages of an order command; each measured from the end of the
+// previous stage.
+const (
+	stageEnqueue = "enqueue" // Order event inserted to enqueued for matching.
+	stageMatch   = "match"   // Enqueued to result output by the matcher.
+	stageStore   = "store"   // Matched to result stored.
+	stageConsume = "consume" // Result stored to order updated.
+	stageTotal   = "total"   // Order event inserted to order updated.
+)
+
+// Trace is the timeline of an order command through the exchange pipeline.
+// Stages not reached (or not traced by this process) are zero.
+type Trace struct {
+	Sequence int64
+	OrderID  int64
+
+	Inserted time.Time // Order event timestamp.
+	Enqueued time.Time // Enqueued for matching.
+	Matched  time.Time // Result output by the matcher.
+	Stored   time.Time // Result stored.
+	Updated  time.Time // Order updated by the result consumer.
+}
+
+// Latency returns the duration from insert to the last stage reached.
+func (t Trace) Latency() time.Duration {
+	for _, ts := range []time.Time{t.Updated, t.Stored, t.Matched, t.Enqueued} {
+		if !ts.IsZero() {
+			return ts.Sub(t.Inserted)
+		}
+	}
+	return 0
+}
+
+// Tracer records the traces of the most recent order commands. Provide
+// the same tracer to Run and ConsumeResults via WithTracer to trace the
+// whole pipeline. A nil tracer records nothing.
+type Tracer struct {
+	mu     sync.Mutex
+	limit  int
+	traces map[int64]*Trace // By sequence
+	seqs   []int64          // In order of insertion for eviction
+}
+
+// NewTracer returns a tracer that keeps up to limit traces.
+func NewTracer(limit int) *Tracer {
+	return &Tracer{
+		limit:  limit,
+		traces: make(map[int64]*Trace),
+	}
+}
+
+// Traces returns the traces of the order's commands.
+func (t *Tracer) Traces(orderID int64) []Trace {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var res []Trace
+	for _, seq := range t.seqs {
+		if tr := t.traces[seq]; tr.OrderID == orderID {
+			res = append(res, *tr)
+		}
+	}
+	return res
+}
+
+// SlowOrders returns up to n traces with the highest latency in
+// descending order.
+func (t *Tracer) SlowOrders(n int) []Trace {
+	t.mu.Lock()
+	res := make([]Trace, 0, len(t.traces))
+	for _, seq := range t.seqs {
+		res = append(res, *t.traces[seq])
+	}
+	t.mu.Unlock()
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Latency() > res[j].Latency()
+	})
+
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+// ListSlowOrders returns up to n traces of the orders created at or after
+// since with the highest latency in descending order. Unlike the Tracer,
+// it queries the persisted order timestamps, so it includes orders traced
+// by other processes or before a restart. Only the insert and last update
+// stages are known.
+func ListSlowOrders(ctx context.Context, dbc *sql.DB, since time.Time, n int) ([]Trace, error) {
+	ol, err := orders.ListSlow(ctx, dbc, since, n)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []Trace
+	for _, o := range ol {
+		res = append(res, Trace{
+			Sequence: o.UpdateSeq,
+			OrderID:  o.ID,
+			Inserted: o.CreatedAt,
+			Updated:  o.UpdatedAt,
+		})
+	}
+
+	return res, nil
+}
+
+// enqueued starts the trace of the sequence and returns the duration
+// since the order event was inserted.
+func (t *Tracer) enqueued(seq, orderID int64, inserted, now time.Time) time.Duration {
+	if t == nil {
+		return now.Sub(inserted)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.traces[seq]; !ok {
+		t.seqs = append(t.seqs, seq)
+	}
+	t.traces[seq] = &Trace{
+		Sequence: seq,
+		OrderID:  orderID,
+		Inserted: inserted,
+		Enqueued: now,
+	}
+
+	for len(t.seqs) > t.limit {
+		delete(t.traces, t.seqs[0])
+		t.seqs = t.seqs[1:]
+	}
+
+	return now.Sub(inserted)
+}
+
+// matched records the match of the sequence and returns the duration
+// since it was enqueued. It returns false if the sequence isn't traced.
+func (t *Tracer) matched(seq int64, now time.Time) (time.Duration, bool) {
+	return t.update(seq, func(tr *Trace) time.Duration {
+		tr.Matched = now
+		return now.Sub(tr.Enqueued)
+	})
+}
+
+// stored records the result of the sequence as stored and returns the
+// duration since it was matched. It returns false if the sequence isn't
+// traced.
+func (t *Tracer) stored(seq int64, now time.Time) (time.Duration, bool) {
+	return t.update(seq, func(tr *Trace) time.Duration {
+		tr.Stored = now
+		return now.Sub(tr.Matched)
+	})
+}
+
+// updated records the order of the sequence as updated and returns the
+// total duration since the order event was inserted. It returns false if
+// the sequence isn't traced.
+func (t *Tracer) updated(seq int64, now time.Time) (time.Duration, bool) {
+	return t.update(seq, func(tr *Trace) time.Duration {
+		tr.Updated = now
+		return now.Sub(tr.Inserted)
+	})
+}
+
+func (t *Tracer) update(seq int64, fn func(*Trace) time.Duration) (time.Duration, bool) {
+	if t == nil {
+		return 0, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tr, ok := t.traces[seq]
+	if !ok {
+		return 0, false
+	}
+
+	return fn(tr), true
+}
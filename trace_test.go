@@ -0,0 +1,66 @@
+package exchange
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracer(t *testing.T) {
+	t0 := time.Unix(0, 0)
+	at := func(ms int) time.Time {
+		return t0.Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	tr := NewTracer(2)
+
+	require.Equal(t, 5*time.Millisecond, tr.enqueued(1, 10, t0, at(5)))
+	require.Equal(t, time.Millisecond, tr.enqueued(2, 11, t0, at(1)))
+
+	d, ok := tr.matched(1, at(7))
+	require.True(t, ok)
+	require.Equal(t, 2*time.Millisecond, d)
+
+	d, ok = tr.stored(1, at(10))
+	require.True(t, ok)
+	require.Equal(t, 3*time.Millisecond, d)
+
+	d, ok = tr.updated(1, at(20))
+	require.True(t, ok)
+	require.Equal(t, 20*time.Millisecond, d)
+
+	_, ok = tr.matched(3, at(20))
+	require.False(t, ok)
+
+	tl := tr.Traces(10)
+	require.Len(t, tl, 1)
+	require.Equal(t, Trace{
+		Sequence: 1,
+		OrderID:  10,
+		Inserted: t0,
+		Enqueued: at(5),
+		Matched:  at(7),
+		Stored:   at(10),
+		Updated:  at(20),
+	}, tl[0])
+
+	slow := tr.SlowOrders(1)
+	require.Len(t, slow, 1)
+	require.Equal(t, int64(1), slow[0].Sequence)
+	require.Equal(t, 20*time.Millisecond, slow[0].Latency())
+
+	// The oldest trace is evicted.
+	tr.enqueued(3, 12, t0, at(100))
+	require.Empty(t, tr.Traces(10))
+	slow = tr.SlowOrders(10)
+	require.Len(t, slow, 2)
+	require.Equal(t, int64(3), slow[0].Sequence)
+	require.Equal(t, int64(2), slow[1].Sequence)
+
+	// A nil tracer records nothing.
+	var nilTracer *Tracer
+	require.Equal(t, time.Millisecond, nilTracer.enqueued(1, 10, t0, at(1)))
+	_, ok = nilTracer.updated(1, at(2))
+	require.False(t, ok)
+}